@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Access tokens are HS256 JWTs which can be verified without a database lookup. They are only issued
+// when session.mode is "jwt", alongside a refresh token which is stored in the tokens collection.
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+var errInvalidAccessToken = errors.New("invalid access token")
+
+type AccessTokenClaims struct {
+	Subject   string `json:"sub"`
+	SessionID string `json:"sid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func isAccessToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func signAccessToken(username string, sessionID primitive.ObjectID) (string, error) {
+	nowTime := time.Now().UTC()
+	claims, err := json.Marshal(AccessTokenClaims{
+		Subject:   username,
+		SessionID: sessionID.Hex(),
+		IssuedAt:  nowTime.Unix(),
+		ExpiresAt: nowTime.Add(config.Session.AccessTokenLifetime.Duration).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, deriveKey("access-token"))
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func verifyAccessToken(token string) (*AccessTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, errInvalidAccessToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidAccessToken
+	}
+	mac := hmac.New(sha256.New, deriveKey("access-token"))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errInvalidAccessToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidAccessToken
+	}
+	var claims AccessTokenClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil || claims.Subject == "" || time.Now().UTC().Unix() >= claims.ExpiresAt {
+		return nil, errInvalidAccessToken
+	}
+	return &claims, nil
+}
+
+// sessionFilter returns a filter matching the tokens collection document for an opaque or access token.
+func sessionFilter(token string) bson.M {
+	if isAccessToken(token) {
+		claims, err := verifyAccessToken(token)
+		if err != nil {
+			return bson.M{"_id": primitive.NilObjectID}
+		}
+		sessionID, err := primitive.ObjectIDFromHex(claims.SessionID)
+		if err != nil {
+			return bson.M{"_id": primitive.NilObjectID}
+		}
+		return bson.M{"_id": sessionID}
+	}
+	return bson.M{"token": hashToken(token)}
+}
+
+// Refresh tokens are "<family>.<secret>", where the family is random and stays the same for the whole session,
+// and the secret changes every time the token is used. A token whose family is known but whose secret isn't the
+// current one has already been used, which can't be guessed without having held a token of the session.
+
+// newRefreshToken returns a refresh token in the given family, or in a new family if it is empty.
+func newRefreshToken(family string) (string, error) {
+	if family == "" {
+		bytes, err := generateToken()
+		if err != nil {
+			return "", err
+		}
+		family = base64.RawURLEncoding.EncodeToString(bytes)
+	}
+	bytes, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	return family + "." + base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// createRefreshSession issues a new refresh token for the user, and returns it with its session ID.
+func createRefreshSession(r *http.Request, username string) (string, primitive.ObjectID, error) {
+	token, err := newRefreshToken("")
+	if err != nil {
+		return "", primitive.NilObjectID, err
+	}
+	nowTime := time.Now().UTC()
+	result, err := database.Collection("tokens").InsertOne(mongoCtx, bson.M{
+		"token":      hashToken(token),
+		"kind":       "refresh",
+		"family":     hashToken(strings.Split(token, ".")[0]),
+		"username":   username,
+		"issuedOn":   nowTime,
+		"expiresAt":  sessionExpiresAt(nowTime, nowTime),
+		"lastUsedAt": nowTime,
+		"userAgent":  r.UserAgent(),
+		"ip":         clientIP(r),
+	})
+	if err != nil {
+		return "", primitive.NilObjectID, err
+	}
+	return token, result.InsertedID.(primitive.ObjectID), nil
+}
+
+type RefreshTokenData struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+func refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var refreshData RefreshTokenData
+	err = json.Unmarshal(body, &refreshData)
+	if err != nil || refreshData.RefreshToken == "" {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	family := strings.Split(refreshData.RefreshToken, ".")[0]
+	if family == refreshData.RefreshToken {
+		http.Error(w, `{"error":"Invalid refresh token provided!"}`, http.StatusUnauthorized)
+		return
+	}
+	newToken, err := newRefreshToken(family)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	oldTokenHash := hashToken(refreshData.RefreshToken)
+	nowTime := time.Now().UTC()
+	var document TokenDocument
+	err = database.Collection("tokens").FindOne(mongoCtx, bson.M{
+		"family": hashToken(family), "kind": "refresh", "expiresAt": bson.M{"$gt": nowTime},
+	}).Decode(&document)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, `{"error":"Invalid refresh token provided!"}`, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	// A token with a different secret was already used, and has been stolen if it is used again.
+	if document.Token != oldTokenHash {
+		err = mongo.ErrNoDocuments
+	} else {
+		after := options.After
+		err = database.Collection("tokens").FindOneAndUpdate(
+			mongoCtx,
+			bson.M{"_id": document.ID, "token": oldTokenHash},
+			bson.M{
+				"$set": bson.M{
+					"token":      hashToken(newToken),
+					"lastUsedAt": nowTime,
+					"expiresAt":  sessionExpiresAt(document.IssuedOn, nowTime),
+				},
+			},
+			&options.FindOneAndUpdateOptions{ReturnDocument: &after},
+		).Decode(&document)
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// This refresh token was already used (possibly at the same time), so revoke the whole session.
+		_, err = database.Collection("tokens").DeleteOne(mongoCtx, bson.M{"_id": document.ID})
+		if err != nil {
+			log.Println(err)
+			http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+			return
+		}
+		recordAuditEvent(r, document.Username, auditTokenRevoke, auditFailure, "Refresh token reused, session "+document.ID.Hex())
+		http.Error(w, `{"error":"Refresh token has already been used! Please log in again."}`, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	accessToken, err := signAccessToken(document.Username, document.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	// Clients using the session cookie get the new access token in it.
+	if _, err = r.Cookie(config.Cookie.Name); err == nil {
+		setSessionCookie(w, accessToken)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":        accessToken,
+		"refreshToken": newToken,
+		"expiresIn":    int(config.Session.AccessTokenLifetime.Seconds()),
+	})
+}
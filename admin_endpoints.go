@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const roleUser = "user"
+const roleAdmin = "admin"
+
+const adminUsersDefaultLimit = 50
+const adminUsersMaxLimit = 100
+
+// userHasRole checks if a user has a role. Users without a role stored have the user role.
+func userHasRole(username string, role string) (bool, error) {
+	var user struct {
+		Role string `bson:"role"`
+	}
+	err := database.Collection("users").FindOne(
+		mongoCtx, bson.M{"username": username}, options.FindOne().SetProjection(bson.M{"role": 1}),
+	).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if user.Role == "" {
+		user.Role = roleUser
+	}
+	return user.Role == role, nil
+}
+
+// promoteAdmins gives the admin role to the users listed in config.json, so an instance always has an admin.
+// Only existing, verified accounts are promoted. The first time a username is promoted, the account is recorded
+// in admin_promotions, and later startups only promote that account, even if it has since been renamed, so
+// whoever takes over the username after a rename or deletion doesn't become an admin.
+func promoteAdmins(usernames []string) error {
+	for _, username := range usernames {
+		var promotion AdminPromotionDocument
+		err := database.Collection("admin_promotions").FindOne(mongoCtx, bson.M{"username": username}).Decode(&promotion)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			var user struct {
+				ID primitive.ObjectID `bson:"_id"`
+			}
+			err = database.Collection("users").FindOne(
+				mongoCtx,
+				bson.M{"username": username, "verified": bson.M{"$in": bson.A{"", nil}}},
+				options.FindOne().SetProjection(bson.M{"_id": 1}),
+			).Decode(&user)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				log.Printf("Not promoting %s to admin, since no verified account has this username.\n", username)
+				continue
+			} else if err != nil {
+				return err
+			}
+			promotion = AdminPromotionDocument{Username: username, UserID: user.ID, PromotedAt: time.Now().UTC()}
+			_, err = database.Collection("admin_promotions").InsertOne(mongoCtx, promotion)
+			if err != nil {
+				return err
+			}
+			infoLog.Printf("Promoted %s to admin.\n", username)
+		} else if err != nil {
+			return err
+		}
+		result, err := database.Collection("users").UpdateOne(
+			mongoCtx, bson.M{"_id": promotion.UserID}, bson.M{"$set": bson.M{"role": roleAdmin}},
+		)
+		if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			log.Printf("Not promoting %s to admin, since the account first promoted for it has been deleted.\n", username)
+		}
+	}
+	return nil
+}
+
+type AdminUserData struct {
+	Username         string     `json:"username"`
+	Email            string     `json:"email"`
+	Role             string     `json:"role"`
+	Verified         bool       `json:"verified"`
+	Disabled         bool       `json:"disabled"`
+	TwoFactorEnabled bool       `json:"twoFactorEnabled"`
+	DeleteAfter      *time.Time `json:"deleteAfter"`
+	SuspendedUntil   *time.Time `json:"suspendedUntil"`
+	SuspensionReason string     `json:"suspensionReason,omitempty"`
+	SuspendedBy      string     `json:"suspendedBy,omitempty"`
+	LastEdited       time.Time  `json:"lastEdited"`
+}
+
+type AdminUserDetailsData struct {
+	AdminUserData
+	Sessions    int64 `json:"sessions"`
+	OAuthTokens int64 `json:"oauthTokens"`
+	APIKeys     int64 `json:"apiKeys"`
+}
+
+func adminUserData(user UserDocument) AdminUserData {
+	data := AdminUserData{
+		Username:         user.Username,
+		Email:            user.Email,
+		Role:             user.Role,
+		Verified:         user.Verified == "",
+		Disabled:         user.Disabled,
+		TwoFactorEnabled: user.TOTPSecret != "",
+		LastEdited:       user.LastEdited,
+	}
+	if data.Role == "" {
+		data.Role = roleUser
+	}
+	if !user.DeleteAfter.IsZero() {
+		data.DeleteAfter = &user.DeleteAfter
+	}
+	// Expired suspensions are left in the database, but no longer apply.
+	if user.SuspendedUntil.After(time.Now()) {
+		data.SuspendedUntil = &user.SuspendedUntil
+		data.SuspensionReason = user.SuspensionReason
+		data.SuspendedBy = user.SuspendedBy
+	}
+	return data
+}
+
+func getAdminUsersHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	page, limit, ok := parsePagination(w, r, adminUsersDefaultLimit, adminUsersMaxLimit)
+	if !ok {
+		return
+	}
+	filter := bson.M{}
+	if search := r.URL.Query().Get("search"); search != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(search), Options: "i"}
+		filter = bson.M{"$or": bson.A{bson.M{"username": pattern}, bson.M{"email": pattern}}}
+	}
+	total, err := database.Collection("users").CountDocuments(mongoCtx, filter)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	cursor, err := database.Collection("users").Find(
+		mongoCtx,
+		filter,
+		options.Find().
+			SetProjection(bson.M{"todos": 0}).
+			SetSort(bson.M{"username": 1}).
+			SetSkip(int64((page-1)*limit)).
+			SetLimit(int64(limit)),
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	var documents []UserDocument
+	err = cursor.All(mongoCtx, &documents)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	users := make([]AdminUserData, 0, len(documents))
+	for _, document := range documents {
+		users = append(users, adminUserData(document))
+	}
+	json.NewEncoder(w).Encode(struct {
+		Users []AdminUserData `json:"users"`
+		Total int64           `json:"total"`
+		Page  int             `json:"page"`
+		Limit int             `json:"limit"`
+	}{Users: users, Total: total, Page: page, Limit: limit})
+}
+
+// adminUserHandler handles /admin/users/:username and the actions under it.
+func adminUserHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	pathSegments := strings.Split(r.URL.Path, "/")[3:]
+	if len(pathSegments) == 1 && r.Method == "GET" {
+		getAdminUserHandler(w, r, pathSegments[0])
+		return
+	} else if len(pathSegments) == 2 && pathSegments[1] == "auditlog" && r.Method == "GET" {
+		adminAuditLogHandler(w, r, pathSegments[0])
+		return
+	} else if len(pathSegments) != 2 {
+		http.NotFound(w, r)
+		return
+	} else if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	target := pathSegments[0]
+	switch pathSegments[1] {
+	case "disable":
+		setUserDisabledHandler(w, r, username, target, true)
+	case "enable":
+		setUserDisabledHandler(w, r, username, target, false)
+	case "logout":
+		adminLogoutUserHandler(w, r, username, target)
+	case "resendverification":
+		adminResendVerificationHandler(w, r, username, target)
+	case "verify":
+		adminVerifyUserHandler(w, r, username, target)
+	case "role":
+		setUserRoleHandler(w, r, username, target)
+	case "suspend":
+		suspendUserHandler(w, r, username, target)
+	case "unsuspend":
+		unsuspendUserHandler(w, r, username, target)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// findAdminTargetUser finds the user an admin endpoint acts on, writing a 404 if they don't exist.
+func findAdminTargetUser(w http.ResponseWriter, username string) (UserDocument, bool) {
+	var user UserDocument
+	err := database.Collection("users").FindOne(
+		mongoCtx, bson.M{"username": username}, options.FindOne().SetProjection(bson.M{"todos": 0}),
+	).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, `{"error":"User not found!"}`, http.StatusNotFound)
+		return user, false
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return user, false
+	}
+	return user, true
+}
+
+func getAdminUserHandler(w http.ResponseWriter, r *http.Request, target string) {
+	user, ok := findAdminTargetUser(w, target)
+	if !ok {
+		return
+	}
+	nowTime := time.Now().UTC()
+	data := AdminUserDetailsData{AdminUserData: adminUserData(user)}
+	counts := []struct {
+		count      *int64
+		collection string
+		filter     bson.M
+	}{
+		{&data.Sessions, "tokens", bson.M{
+			"username": target, "clientId": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": nowTime},
+		}},
+		{&data.OAuthTokens, "tokens", bson.M{
+			"username": target, "clientId": bson.M{"$exists": true}, "expiresAt": bson.M{"$gt": nowTime},
+		}},
+		{&data.APIKeys, "api_keys", bson.M{"username": target, "expiresAt": bson.M{"$gt": nowTime}}},
+	}
+	for _, c := range counts {
+		count, err := database.Collection(c.collection).CountDocuments(mongoCtx, c.filter)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+			return
+		}
+		*c.count = count
+	}
+	json.NewEncoder(w).Encode(data)
+}
+
+// revokeUserSessions logs a user out of all devices, including pending 2FA logins.
+func revokeUserSessions(username string) error {
+	_, err := database.Collection("tokens").DeleteMany(mongoCtx, bson.M{"username": username})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("login_challenges").DeleteMany(mongoCtx, bson.M{"username": username})
+	return err
+}
+
+func setUserDisabledHandler(w http.ResponseWriter, r *http.Request, username string, target string, disabled bool) {
+	if disabled && target == username {
+		http.Error(w, `{"error":"You cannot disable your own account!"}`, http.StatusBadRequest)
+		return
+	}
+	update := bson.M{"$unset": bson.M{"disabled": 1}}
+	if disabled {
+		update = bson.M{"$set": bson.M{"disabled": true}}
+	}
+	result, err := database.Collection("users").UpdateOne(mongoCtx, bson.M{"username": target}, update)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if result.MatchedCount != 1 {
+		http.Error(w, `{"error":"User not found!"}`, http.StatusNotFound)
+		return
+	}
+	if disabled {
+		// Disabled accounts are rejected when authenticating, and revoking their sessions means they have to
+		// log in again if they are enabled.
+		err = revokeUserSessions(target)
+		if err == nil {
+			_, err = database.Collection("api_keys").DeleteMany(mongoCtx, bson.M{"username": target})
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+			return
+		}
+		recordAuditEvent(r, target, auditTokenRevoke, auditSuccess, "All sessions and API keys, account disabled by "+username)
+		infoLog.Printf("%s disabled the account of %s.\n", username, target)
+	} else {
+		infoLog.Printf("%s enabled the account of %s.\n", username, target)
+	}
+	w.Write([]byte(`{"success":true}`))
+}
+
+func adminLogoutUserHandler(w http.ResponseWriter, r *http.Request, username string, target string) {
+	if _, ok := findAdminTargetUser(w, target); !ok {
+		return
+	}
+	err := revokeUserSessions(target)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	recordAuditEvent(r, target, auditTokenRevoke, auditSuccess, "All sessions, by "+username)
+	infoLog.Printf("%s logged out %s from all devices.\n", username, target)
+	w.Write([]byte(`{"success":true}`))
+}
+
+func adminResendVerificationHandler(w http.ResponseWriter, r *http.Request, username string, target string) {
+	user, ok := findAdminTargetUser(w, target)
+	if !ok {
+		return
+	} else if user.Verified == "" {
+		http.Error(w, `{"error":"Account already verified!"}`, http.StatusBadRequest)
+		return
+	}
+	verifyToken, err := generateVerifyToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	nowTime := time.Now().UTC()
+	// Unlike POST /resendverifyemail, admins aren't limited by verifyResendInterval.
+	updateResult, err := database.Collection("users").UpdateOne(
+		mongoCtx, bson.M{"username": target, "verified": user.Verified}, bson.M{"$set": bson.M{
+			"verified":        hashToken(verifyToken),
+			"verifyExpiresAt": nowTime.Add(verifyTokenLifetime),
+			"verifySentAt":    nowTime,
+		}},
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if updateResult.ModifiedCount != 1 {
+		http.Error(w, `{"error":"Account already verified!"}`, http.StatusBadRequest)
+		return
+	}
+	err = sendVerificationEmail(user.Email, user.Username, verifyToken)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Failed to send verification email!"}`, http.StatusInternalServerError)
+		return
+	}
+	infoLog.Printf("%s resent the verification email of %s.\n", username, target)
+	w.Write([]byte(`{"success":true}`))
+}
+
+func adminVerifyUserHandler(w http.ResponseWriter, r *http.Request, username string, target string) {
+	result, err := database.Collection("users").UpdateOne(mongoCtx, bson.M{"username": target}, bson.M{
+		"$set":   bson.M{"verified": ""},
+		"$unset": bson.M{"verifyExpiresAt": 1, "verifySentAt": 1},
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if result.MatchedCount != 1 {
+		http.Error(w, `{"error":"User not found!"}`, http.StatusNotFound)
+		return
+	}
+	infoLog.Printf("%s verified the account of %s.\n", username, target)
+	w.Write([]byte(`{"success":true}`))
+}
+
+type SetUserRoleData struct {
+	Role string `json:"role"`
+}
+
+func setUserRoleHandler(w http.ResponseWriter, r *http.Request, username string, target string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var roleData SetUserRoleData
+	err = json.Unmarshal(body, &roleData)
+	if err != nil || (roleData.Role != roleUser && roleData.Role != roleAdmin) {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	} else if target == username {
+		// Otherwise the last admin could lock everyone out of the admin endpoints.
+		http.Error(w, `{"error":"You cannot change your own role!"}`, http.StatusBadRequest)
+		return
+	}
+	update := bson.M{"$unset": bson.M{"role": 1}}
+	if roleData.Role != roleUser {
+		update = bson.M{"$set": bson.M{"role": roleData.Role}}
+	}
+	result, err := database.Collection("users").UpdateOne(mongoCtx, bson.M{"username": target}, update)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if result.MatchedCount != 1 {
+		http.Error(w, `{"error":"User not found!"}`, http.StatusNotFound)
+		return
+	}
+	infoLog.Printf("%s changed the role of %s to %s.\n", username, target, roleData.Role)
+	w.Write([]byte(`{"success":true}`))
+}
+
+func adminAuditLogHandler(w http.ResponseWriter, r *http.Request, target string) {
+	if _, ok := findAdminTargetUser(w, target); !ok {
+		return
+	}
+	writeAuditLog(w, r, target)
+}
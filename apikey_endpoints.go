@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const apiKeyPrefix = "cak_"
+const apiKeyDefaultLifetime = time.Hour * 24 * 90
+const apiKeyMaxLifetime = time.Hour * 24 * 366
+
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// checkAPIKey returns the user and scopes of an API key, or an empty username if the key is invalid or its
+// account can't be used. Keys of suspended accounts return an *accountSuspendedError.
+func checkAPIKey(key string) (string, []string, error) {
+	var document APIKeyDocument
+	nowTime := time.Now().UTC()
+	err := database.Collection("api_keys").FindOne(mongoCtx, bson.M{
+		"key": hashToken(key), "expiresAt": bson.M{"$gt": nowTime},
+	}).Decode(&document)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", nil, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+	active, err := checkAccountStatus(document.Username)
+	if err != nil || !active {
+		return "", nil, err
+	}
+	if nowTime.Sub(document.LastUsedAt) >= config.Session.LastUsedInterval.Duration {
+		_, err = database.Collection("api_keys").UpdateOne(
+			mongoCtx, bson.M{"_id": document.ID}, bson.M{"$set": bson.M{"lastUsedAt": nowTime}},
+		)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return document.Username, document.Scopes, nil
+}
+
+type APIKeyData struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	Key        string     `json:"key,omitempty"`
+}
+
+func apiKeysHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	if r.Method == "POST" {
+		createAPIKeyHandler(w, r, username)
+	} else {
+		getAPIKeysHandler(w, r, username)
+	}
+}
+
+func getAPIKeysHandler(w http.ResponseWriter, r *http.Request, username string) {
+	cursor, err := database.Collection("api_keys").Find(
+		mongoCtx, bson.M{"username": username}, options.Find().SetSort(bson.M{"createdAt": -1}),
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	var documents []APIKeyDocument
+	err = cursor.All(mongoCtx, &documents)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	keys := make([]APIKeyData, 0, len(documents))
+	for _, document := range documents {
+		key := APIKeyData{
+			ID:        document.ID.Hex(),
+			Name:      document.Name,
+			Scopes:    document.Scopes,
+			CreatedAt: document.CreatedAt,
+			ExpiresAt: document.ExpiresAt,
+		}
+		if !document.LastUsedAt.IsZero() {
+			lastUsedAt := document.LastUsedAt
+			key.LastUsedAt = &lastUsedAt
+		}
+		keys = append(keys, key)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Keys []APIKeyData `json:"keys"`
+	}{Keys: keys})
+}
+
+type CreateAPIKeyData struct {
+	Name      string          `json:"name"`
+	Scopes    []string        `json:"scopes"`
+	ExpiresAt json.RawMessage `json:"expiresAt"`
+}
+
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request, username string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var keyData CreateAPIKeyData
+	err = json.Unmarshal(body, &keyData)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	} else if keyData.Name == "" || len(keyData.Name) > 64 {
+		http.Error(w, `{"error":"API key name must be 1-64 characters long!"}`, http.StatusBadRequest)
+		return
+	} else if !validScopes(keyData.Scopes) {
+		http.Error(w, `{"error":"Invalid scopes provided!"}`, http.StatusBadRequest)
+		return
+	}
+	nowTime := time.Now().UTC()
+	expiresAt := nowTime.Add(apiKeyDefaultLifetime)
+	if len(keyData.ExpiresAt) > 0 && string(keyData.ExpiresAt) != "null" {
+		expiresAt, err = time.Parse("2006-01-02T15:04:05.999Z07:00", strings.Trim(string(keyData.ExpiresAt), `"`))
+		if err != nil || !expiresAt.After(nowTime) || expiresAt.After(nowTime.Add(apiKeyMaxLifetime)) {
+			http.Error(w, `{"error":"Invalid expiry date provided! API keys can last up to 1 year."}`, http.StatusBadRequest)
+			return
+		}
+		expiresAt = expiresAt.UTC()
+	}
+	bytes, err := generateToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	key := apiKeyPrefix + hex.EncodeToString(bytes)
+	result, err := database.Collection("api_keys").InsertOne(mongoCtx, bson.M{
+		"key":       hashToken(key),
+		"username":  username,
+		"name":      keyData.Name,
+		"scopes":    keyData.Scopes,
+		"createdAt": nowTime,
+		"expiresAt": expiresAt,
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(APIKeyData{
+		ID:        result.InsertedID.(primitive.ObjectID).Hex(),
+		Name:      keyData.Name,
+		Scopes:    keyData.Scopes,
+		CreatedAt: nowTime,
+		ExpiresAt: expiresAt,
+		Key:       key,
+	})
+}
+
+func deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	pathSegments := strings.Split(r.URL.Path, "/")[2:]
+	if len(pathSegments) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(pathSegments[0])
+	if err != nil {
+		http.Error(w, `{"error":"API key not found!"}`, http.StatusNotFound)
+		return
+	}
+	result, err := database.Collection("api_keys").DeleteOne(mongoCtx, bson.M{"_id": id, "username": username})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if result.DeletedCount == 0 {
+		http.Error(w, `{"error":"API key not found!"}`, http.StatusNotFound)
+		return
+	}
+	recordAuditEvent(r, username, auditTokenRevoke, auditSuccess, "API key "+id.Hex())
+	w.Write([]byte(`{"success":true}`))
+}
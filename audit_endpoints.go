@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Security-relevant events are appended to audit_events, so users and admins can see what happened to an
+// account. Events are never modified, and are removed by the TTL index on expiresAt after the retention period.
+// Each event keeps the username the user had when it was recorded, and is found by the user's ID, so the log
+// follows the user when they change their username without rewriting old events.
+
+const auditLogin = "login"
+const auditLogout = "logout"
+const auditRegister = "register"
+const auditPasswordChange = "password_change"
+const auditPasswordReset = "password_reset"
+const auditAccountDelete = "account_delete"
+const auditAccountRestore = "account_restore"
+const auditTokenRevoke = "token_revoke"
+const auditAccountSuspend = "account_suspend"
+const auditAccountUnsuspend = "account_unsuspend"
+const auditUsernameChange = "username_change"
+
+const auditSuccess = "success"
+const auditFailure = "failure"
+
+type AuditConfig struct {
+	Retention Duration `json:"retention"`
+}
+
+func (c *AuditConfig) setDefaults() error {
+	if c.Retention.Duration < 0 {
+		return fmt.Errorf("audit.retention must not be negative")
+	} else if c.Retention.Duration == 0 {
+		c.Retention.Duration = time.Hour * 24 * 90
+	}
+	return nil
+}
+
+// userID returns the ID of a user, which unlike their username never changes.
+func userID(ctx context.Context, username string) (primitive.ObjectID, error) {
+	var user struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err := database.Collection("users").FindOne(
+		ctx, bson.M{"username": username}, options.FindOne().SetProjection(bson.M{"_id": 1}),
+	).Decode(&user)
+	return user.ID, err
+}
+
+// recordAuditEvent appends an event to a user's audit log. Failing to record an event is logged, but doesn't
+// fail the request it was recorded for.
+func recordAuditEvent(r *http.Request, username string, event string, outcome string, details string) {
+	id, err := userID(mongoCtx, username)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	nowTime := time.Now().UTC()
+	_, err = database.Collection("audit_events").InsertOne(mongoCtx, AuditEventDocument{
+		UserID:    id,
+		Username:  username,
+		Event:     event,
+		Outcome:   outcome,
+		Details:   details,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		CreatedAt: nowTime,
+		ExpiresAt: nowTime.Add(config.Audit.Retention.Duration),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+type AuditEventData struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	Outcome   string    `json:"outcome"`
+	Details   string    `json:"details"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func auditEventData(document AuditEventDocument) AuditEventData {
+	return AuditEventData{
+		ID:        document.ID.Hex(),
+		Event:     document.Event,
+		Outcome:   document.Outcome,
+		Details:   document.Details,
+		IP:        document.IP,
+		UserAgent: document.UserAgent,
+		CreatedAt: document.CreatedAt,
+	}
+}
+
+// parsePagination reads the page and limit query parameters, writing a 400 if they are invalid.
+func parsePagination(w http.ResponseWriter, r *http.Request, defaultLimit int, maxLimit int) (int, int, bool) {
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if query.Get("page") == "" {
+		page = 1
+	} else if err != nil || page < 1 {
+		http.Error(w, `{"error":"Invalid page provided!"}`, http.StatusBadRequest)
+		return 0, 0, false
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if query.Get("limit") == "" {
+		limit = defaultLimit
+	} else if err != nil || limit < 1 || limit > maxLimit {
+		http.Error(w, `{"error":"Invalid limit provided!"}`, http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return page, limit, true
+}
+
+func findAuditEvents(id primitive.ObjectID, page int, limit int) (*mongo.Cursor, error) {
+	return database.Collection("audit_events").Find(
+		mongoCtx,
+		bson.M{"userId": id},
+		options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).
+			SetSkip(int64((page-1)*limit)).
+			SetLimit(int64(limit)),
+	)
+}
+
+// writeAuditLog writes a page of a user's audit log, newest first.
+func writeAuditLog(w http.ResponseWriter, r *http.Request, username string) {
+	page, limit, ok := parsePagination(w, r, 50, 100)
+	if !ok {
+		return
+	}
+	id, err := userID(mongoCtx, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	cursor, err := findAuditEvents(id, page, limit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	var documents []AuditEventDocument
+	err = cursor.All(mongoCtx, &documents)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	events := make([]AuditEventData, 0, len(documents))
+	for _, document := range documents {
+		events = append(events, auditEventData(document))
+	}
+	json.NewEncoder(w).Encode(struct {
+		Events []AuditEventData `json:"events"`
+		Page   int              `json:"page"`
+		Limit  int              `json:"limit"`
+	}{Events: events, Page: page, Limit: limit})
+}
+
+func getAuditLogHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	writeAuditLog(w, r, username)
+}
@@ -1,26 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
-	"encoding/base64"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
 	"log"
 	"net/http"
-	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"golang.org/x/crypto/argon2"
 )
 
-func hashPassword(password string, salt string) string {
-	return hex.EncodeToString(argon2.IDKey([]byte(password), []byte(salt), 1, 50*1024, 4, 32))
-}
+var secretKey []byte
 
 func generateToken() ([]byte, error) {
 	token := make([]byte, 32)
@@ -31,9 +31,24 @@ func generateToken() ([]byte, error) {
 	return token, nil
 }
 
+// hashToken returns a digest of a token, for tokens that should not be stored as-is.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// deriveKey derives a key for a specific purpose from the server secret, so keys are never reused.
+func deriveKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, secretKey)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
 type LoginData struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Challenge string `json:"challenge"`
+	Nonce     string `json:"nonce"`
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -53,9 +68,23 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
 		return
 	}
+	// Check for lockouts before hashing the password, so guessing passwords can't be used to exhaust the CPU.
+	attemptKeys := loginAttemptKeys(r, loginData.Username)
+	lockedUntil, failures, err := checkLoginLockout(attemptKeys)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if !lockedUntil.IsZero() {
+		writeLoginLockout(w, lockedUntil)
+		return
+	} else if config.ProofOfWork.LoginAfterFailures > 0 && failures >= config.ProofOfWork.LoginAfterFailures &&
+		!checkProofOfWork(w, loginData.Challenge, loginData.Nonce) {
+		return
+	}
 	result := database.Collection("users").FindOne(mongoCtx, bson.M{"username": loginData.Username})
 	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
-		http.Error(w, `{"error":"Invalid username or password!"}`, http.StatusUnauthorized)
+		loginFailed(w, attemptKeys)
 		return
 	} else if result.Err() != nil {
 		log.Println(result.Err())
@@ -69,47 +98,106 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
 		return
-	} else if hashPassword(loginData.Password, user.Salt) != user.Password {
-		http.Error(w, `{"error":"Invalid username or password!"}`, http.StatusUnauthorized)
+	}
+	ok, needsRehash := verifyPassword(loginData.Password, user.Password, user.Salt)
+	if !ok {
+		recordAuditEvent(r, user.Username, auditLogin, auditFailure, "Invalid password")
+		loginFailed(w, attemptKeys)
+		return
+	}
+	// Failures are only reset once the login completes, so the second factor can't be guessed indefinitely.
+	if needsRehash {
+		err = rehashPassword(&user, loginData.Password)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	if !user.DeleteAfter.IsZero() {
+		recordAuditEvent(r, user.Username, auditLogin, auditFailure, "Account pending deletion")
+		http.Error(w, `{"error":"This account has been deleted! Check your email to restore it."}`, http.StatusForbidden)
+		return
+	} else if user.Disabled {
+		recordAuditEvent(r, user.Username, auditLogin, auditFailure, "Account disabled")
+		http.Error(w, `{"error":"This account has been disabled!"}`, http.StatusForbidden)
+		return
+	} else if user.SuspendedUntil.After(time.Now()) {
+		recordAuditEvent(r, user.Username, auditLogin, auditFailure, "Account suspended")
+		writeAccountSuspended(w, user.SuspendedUntil, user.SuspensionReason)
 		return
 	} else if user.Verified != "" {
 		http.Error(w, `{"error":"Account not verified!"}`, http.StatusUnauthorized)
 		return
+	} else if user.TOTPSecret != "" {
+		createLoginChallenge(w, user.Username)
+		return
 	}
-	bytes, err := generateToken()
+	completeLogin(w, r, user.Username, "password")
+}
+
+func loginFailed(w http.ResponseWriter, attemptKeys []string) {
+	lockedUntil, err := recordLoginFailure(attemptKeys)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
-		return
+	} else if !lockedUntil.IsZero() {
+		writeLoginLockout(w, lockedUntil)
+	} else {
+		http.Error(w, `{"error":"Invalid username or password!"}`, http.StatusUnauthorized)
+	}
+}
+
+// completeLogin issues tokens to a user who has successfully authenticated, and sends them to the client.
+// The method used to authenticate is recorded in the audit log.
+func completeLogin(w http.ResponseWriter, r *http.Request, username string, method string) {
+	response := map[string]interface{}{}
+	var token string
+	var err error
+	if config.Session.Mode == "jwt" {
+		var refreshToken string
+		var sessionID primitive.ObjectID
+		refreshToken, sessionID, err = createRefreshSession(r, username)
+		if err == nil {
+			token, err = signAccessToken(username, sessionID)
+		}
+		response["refreshToken"] = refreshToken
+		response["expiresIn"] = int(config.Session.AccessTokenLifetime.Seconds())
+	} else {
+		token, err = createSession(r, username)
 	}
-	token := base64.StdEncoding.EncodeToString(bytes)
-	_, err = database.Collection("tokens").InsertOne(mongoCtx, bson.M{
-		"token":    token,
-		"username": loginData.Username,
-		"issuedOn": time.Now().UTC(),
-	})
 	if err != nil {
 		log.Println(err)
 		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
 		return
 	}
+	response["token"] = token
+	recordAuditEvent(r, username, auditLogin, auditSuccess, method)
+	err = resetLoginFailures(username)
+	if err != nil {
+		log.Println(err)
+	}
 	if r.URL.Query().Get("cookie") != "false" {
-		// TODO: Add Secure to cookie.
-		r.AddCookie(&http.Cookie{
-			Name:     "cerulean_token",
-			Value:    token,
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-			MaxAge:   31536000,
-		})
+		response["csrfToken"] = csrfToken(token)
+		setSessionCookie(w, token)
 	}
-	json.NewEncoder(w).Encode(map[string]string{"token": token})
+	json.NewEncoder(w).Encode(response)
 }
 
 type RegisterData struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Email    string `json:"email"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Email     string `json:"email"`
+	Invite    string `json:"invite"`
+	Challenge string `json:"challenge"`
+	Nonce     string `json:"nonce"`
+}
+
+// writeDuplicateUserError writes the 409 for a username or email which is already used by another user.
+func writeDuplicateUserError(w http.ResponseWriter, field string) {
+	if field == "email" {
+		http.Error(w, `{"error":"A user with this email already exists!"}`, http.StatusConflict)
+	} else {
+		http.Error(w, `{"error":"A user with this username already exists!"}`, http.StatusConflict)
+	}
 }
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
@@ -128,9 +216,16 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
 		return
+	} else if message := registrationError(registerData.Email); message != "" {
+		errorJson, _ := json.Marshal(map[string]string{"error": message})
+		http.Error(w, string(errorJson), http.StatusForbidden)
+		return
+	} else if config.Registration.Mode == registrationInvite && registerData.Invite == "" {
+		http.Error(w, `{"error":"An invite is required to register!"}`, http.StatusForbidden)
+		return
 	}
 	result := database.Collection("users").FindOne(mongoCtx, bson.M{
-		"$or": bson.A{bson.M{"username": registerData.Username}, bson.M{"email": registerData.Email}},
+		"$or": bson.A{bson.M{"username": registerData.Username}, emailInUseFilter(registerData.Email)},
 	})
 	if result.Err() == nil {
 		var user UserDocument
@@ -138,10 +233,10 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Println(err)
 			http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
-		} else if user.Email == registerData.Email {
-			http.Error(w, `{"error":"A user with this email already exists!"}`, http.StatusConflict)
-		} else {
+		} else if user.Username == registerData.Username {
 			http.Error(w, `{"error":"A user with this username already exists!"}`, http.StatusConflict)
+		} else {
+			http.Error(w, `{"error":"A user with this email already exists!"}`, http.StatusConflict)
 		}
 		return
 	} else if !errors.Is(result.Err(), mongo.ErrNoDocuments) {
@@ -150,169 +245,308 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Validate username, password and email.
-	nameRegex, err := regexp.Compile(`^[a-zA-Z0-9_]{4,16}$`)
-	emailRegex, emailErr := regexp.Compile(`^[a-zA-Z0-9_.+-]+@[a-zA-Z0-9-]+\.[a-zA-Z0-9-.]+$`)
-	if err != nil || emailErr != nil {
-		log.Println(err, emailErr)
-		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
-		return
-	} else if len(registerData.Password) < 8 {
-		http.Error(w, `{"error":"Minimum password length: 8"}`, http.StatusBadRequest)
-		return
-	} else if !emailRegex.MatchString(registerData.Email) || len(registerData.Email) > 254 {
+	if !emailRegex.MatchString(registerData.Email) || len(registerData.Email) > 254 {
 		http.Error(w, `{"error":"Invalid email provided!"}`, http.StatusBadRequest)
 		return
-	} else if !nameRegex.MatchString(registerData.Username) {
+	} else if !usernameRegex.MatchString(registerData.Username) {
 		http.Error(w, `{"error":"Invalid username provided!"}`, http.StatusBadRequest)
 		return
 	}
-	saltBytes, err := generateToken()
+	reserved, err := usernameReserved(mongoCtx, registerData.Username, "")
 	if err != nil {
 		log.Println(err)
 		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
 		return
+	} else if reserved {
+		http.Error(w, `{"error":"A user with this username already exists!"}`, http.StatusConflict)
+		return
 	}
-	salt := hex.EncodeToString(saltBytes)
-	_, err = database.Collection("users").InsertOne(mongoCtx, bson.M{
-		"username":   registerData.Username,
-		"password":   hashPassword(registerData.Password, salt),
-		"email":      registerData.Email,
-		"salt":       salt,
-		"verified":   "",
-		"lastEdited": time.Now().UTC(),
-		"todos":      bson.A{},
-	})
+	reasons, err := checkPasswordPolicy(registerData.Password, registerData.Username, registerData.Email)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
 		return
+	} else if reasons != nil {
+		writePasswordPolicyError(w, "password", reasons)
+		return
+	}
+	// The challenge is only used up once everything else is valid, so clients can fix mistakes without solving
+	// another one.
+	if config.ProofOfWork.Register && !checkProofOfWork(w, registerData.Challenge, registerData.Nonce) {
+		return
 	}
-	// Log the user in for now until email verification is added.
-	bytes, err := generateToken()
+	passwordHash, err := hashPassword(registerData.Password)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
 		return
 	}
-	token := base64.StdEncoding.EncodeToString(bytes)
-	_, err = database.Collection("tokens").InsertOne(mongoCtx, bson.M{
-		"token":    token,
-		"username": registerData.Username,
-		"issuedOn": time.Now().UTC(),
-	})
+	verifyToken, err := generateVerifyToken()
 	if err != nil {
 		log.Println(err)
 		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
 		return
 	}
-	if r.URL.Query().Get("cookie") != "false" {
-		// TODO: Add Secure to cookie.
-		r.AddCookie(&http.Cookie{
-			Name:     "cerulean_token",
-			Value:    token,
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-			MaxAge:   31536000,
-		})
+	nowTime := time.Now().UTC()
+	user := bson.M{
+		"username":        registerData.Username,
+		"password":        passwordHash,
+		"email":           registerData.Email,
+		"verified":        hashToken(verifyToken),
+		"verifyExpiresAt": nowTime.Add(verifyTokenLifetime),
+		"verifySentAt":    nowTime,
+		"lastEdited":      nowTime,
+		"todos":           bson.A{},
 	}
-	json.NewEncoder(w).Encode(map[string]string{"token": token})
+	if config.Registration.Mode == registrationInvite {
+		err = insertInvitedUser(user, registerData.Invite)
+	} else {
+		_, err = database.Collection("users").InsertOne(mongoCtx, user)
+	}
+	if errors.Is(err, errInvalidInvite) {
+		http.Error(w, `{"error":"Invalid or expired invite!"}`, http.StatusForbidden)
+		return
+	} else if field := duplicateUserField(err); field != "" {
+		writeDuplicateUserError(w, field)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	recordAuditEvent(r, registerData.Username, auditRegister, auditSuccess, "")
+	// The user can't log in until they verify, and they can request another email if this fails.
+	err = sendVerificationEmail(registerData.Email, registerData.Username, verifyToken)
+	if err != nil {
+		log.Println(err)
+	}
+	w.Write([]byte(`{"success":true}`))
 }
 
-func isLoggedIn(token string) (string, error) {
-	result := database.Collection("tokens").FindOne(mongoCtx, bson.M{"token": token})
+// isLoggedIn returns the user a session token belongs to and the scopes it grants, or an empty username if the
+// token is invalid or its account can't be used. Tokens of suspended accounts return an *accountSuspendedError.
+func isLoggedIn(token string) (string, []string, error) {
+	if isAccessToken(token) {
+		claims, err := verifyAccessToken(token)
+		if err != nil {
+			return "", nil, nil
+		}
+		// Access tokens outlive the sessions they were issued for, so the account is checked on every request.
+		active, err := checkAccountStatus(claims.Subject)
+		if err != nil || !active {
+			return "", nil, err
+		}
+		return claims.Subject, allScopes, nil
+	}
+	result := database.Collection("tokens").FindOne(mongoCtx, bson.M{
+		"token": hashToken(token), "kind": bson.M{"$ne": "refresh"},
+	})
 	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
-		return "", nil
+		return "", nil, nil
 	} else if result.Err() != nil {
-		return "", result.Err()
+		return "", nil, result.Err()
 	}
 	var document TokenDocument
 	err := result.Decode(&document)
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+	// Expired tokens are removed by the TTL index on expiresAt, which only runs periodically.
+	nowTime := time.Now().UTC()
+	lastUsedAt := document.LastUsedAt
+	if lastUsedAt.IsZero() {
+		lastUsedAt = document.IssuedOn
+	}
+	if !document.ExpiresAt.After(nowTime) || !sessionExpiresAt(document.IssuedOn, lastUsedAt).After(nowTime) {
+		return "", nil, nil
+	}
+	// Suspending, disabling or deleting an account revokes its tokens, but tokens may be issued while that is
+	// being applied.
+	active, err := checkAccountStatus(document.Username)
+	if err != nil || !active {
+		return "", nil, err
+	}
+	// Avoid writing to the database on every request.
+	if nowTime.Sub(lastUsedAt) >= config.Session.LastUsedInterval.Duration {
+		_, err = database.Collection("tokens").UpdateOne(mongoCtx, bson.M{"_id": document.ID}, bson.M{
+			"$set": bson.M{"lastUsedAt": nowTime, "expiresAt": sessionExpiresAt(document.IssuedOn, nowTime)},
+		})
+		if err != nil {
+			return "", nil, err
+		}
 	}
-	// TODO: Idle timeout?
-	if document.IssuedOn.UTC().Add(time.Hour * 24 * 180).Before(time.Now().UTC()) {
-		_, _ = database.Collection("tokens").DeleteOne(mongoCtx, bson.M{"token": token})
-		return "", nil
+	// Tokens issued to OAuth clients are limited to the scopes the user granted.
+	if len(document.Scopes) > 0 {
+		return document.Username, document.Scopes, nil
 	}
-	return document.Username, nil
+	return document.Username, allScopes, nil
 }
 
+const scopeTodosRead = "todos:read"
+const scopeTodosWrite = "todos:write"
+const scopeAccount = "account"
+
+var allScopes = []string{scopeTodosRead, scopeTodosWrite, scopeAccount}
+
+type scopesContextKey struct{}
+
+func validScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, scope := range scopes {
+		if !hasScope(allScopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHasScope checks if the token used for a request handled by handleLoginCheck has a scope.
+func requestHasScope(r *http.Request, scope string) bool {
+	scopes, _ := r.Context().Value(scopesContextKey{}).([]string)
+	return hasScope(scopes, scope)
+}
+
+// authenticate returns the user a token belongs to and the scopes it grants.
+func authenticate(token string) (string, []string, error) {
+	if isAPIKey(token) {
+		return checkAPIKey(token)
+	}
+	return isLoggedIn(token)
+}
+
+// requestToken returns the token from the session cookie or the Authorization header, and whether it came
+// from the cookie.
+func requestToken(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(config.Cookie.Name)
+	if errors.Is(err, http.ErrNoCookie) {
+		return r.Header.Get("Authorization"), false
+	}
+	return cookie.Value, true
+}
+
+// handleLoginCheck wraps an endpoint which requires logging in. The allowed methods are mapped to the scope
+// each one requires, or an empty string if any token can use it.
 func handleLoginCheck(
 	handler func(w http.ResponseWriter, r *http.Request, username string, token string),
-	methods []string,
+	methodScopes map[string]string,
 ) func(w http.ResponseWriter, r *http.Request) {
+	methods := make([]string, 0, len(methodScopes))
+	for method := range methodScopes {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		allowedMethod := false
-		for _, method := range methods {
-			if r.Method == method {
-				allowedMethod = true
-			}
-		}
+		scope, allowedMethod := methodScopes[r.Method]
 		if !allowedMethod {
 			http.Error(w, `{"error":"Allowed methods: `+strings.Join(methods, ", ")+`"}`, http.StatusMethodNotAllowed)
 			return
 		}
-		cookie, err := r.Cookie("cerulean_token")
-		var token string
-		if errors.Is(err, http.ErrNoCookie) {
-			token = r.Header.Get("Authorization")
-		} else {
-			token = cookie.Value
-		}
+		token, fromCookie := requestToken(r)
 		if token == "" {
 			http.Error(w, `{"error":"No access token provided!"}`, http.StatusUnauthorized)
 			return
 		}
-		username, err := isLoggedIn(token)
-		if err != nil {
+		var username string
+		var scopes []string
+		var err error
+		if auth, ok := r.Context().Value(authContextKey{}).(authResult); ok && auth.token == token {
+			username, scopes = auth.username, auth.scopes
+		} else {
+			username, scopes, err = authenticate(token)
+		}
+		var suspended *accountSuspendedError
+		if errors.As(err, &suspended) {
+			writeAccountSuspended(w, suspended.until, suspended.reason)
+			return
+		} else if err != nil {
 			log.Println(err)
 			http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
 			return
 		} else if username == "" {
 			http.Error(w, `{"error":"Invalid access token provided!"}`, http.StatusUnauthorized)
 			return
+		} else if scope != "" && !hasScope(scopes, scope) {
+			http.Error(w, `{"error":"Access token is missing the required scope: `+scope+`"}`, http.StatusForbidden)
+			return
+		} else if fromCookie && !checkCSRF(w, r, token) {
+			return
 		}
+		r = r.WithContext(context.WithValue(r.Context(), scopesContextKey{}, scopes))
 		handler(w, r, username, token)
 	}
 }
 
+// handleRoleCheck is handleLoginCheck for endpoints which can only be used by users with a role.
+func handleRoleCheck(
+	handler func(w http.ResponseWriter, r *http.Request, username string, token string),
+	methods []string,
+	role string,
+) func(w http.ResponseWriter, r *http.Request) {
+	methodScopes := make(map[string]string, len(methods))
+	for _, method := range methods {
+		methodScopes[method] = scopeAccount
+	}
+	return handleLoginCheck(func(w http.ResponseWriter, r *http.Request, username string, token string) {
+		// Only sessions from logging in can use these endpoints, not API keys or tokens issued to OAuth clients,
+		// which are never granted every scope.
+		session := !isAPIKey(token)
+		for _, scope := range allScopes {
+			session = session && requestHasScope(r, scope)
+		}
+		if !session {
+			http.Error(w, `{"error":"This endpoint can only be used after logging in!"}`, http.StatusForbidden)
+			return
+		}
+		allowed, err := userHasRole(username, role)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+			return
+		} else if !allowed {
+			http.Error(w, `{"error":"You do not have permission to access this endpoint!"}`, http.StatusForbidden)
+			return
+		}
+		handler(w, r, username, token)
+	}, methodScopes)
+}
+
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != "POST" {
 		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
 		return
 	}
-	cookie, err := r.Cookie("cerulean_token")
-	var token string
-	if errors.Is(err, http.ErrNoCookie) {
-		token = r.Header.Get("Authorization")
-	} else {
-		token = cookie.Value
-	}
+	token, fromCookie := requestToken(r)
 	if token == "" {
 		http.Error(w, `{"error":"No access token provided!"}`, http.StatusUnauthorized)
 		return
+	} else if fromCookie && !checkCSRF(w, r, token) {
+		return
 	}
-	result, err := database.Collection("tokens").DeleteOne(mongoCtx, bson.M{"token": token})
-	if err != nil {
+	var document TokenDocument
+	err := database.Collection("tokens").FindOneAndDelete(mongoCtx, sessionFilter(token)).Decode(&document)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, `{"error":"Invalid access token provided!"}`, http.StatusUnauthorized)
+		return
+	} else if err != nil {
 		log.Println(err)
 		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
 		return
-	} else if result.DeletedCount == 0 {
-		http.Error(w, `{"error":"Invalid access token provided!"}`, http.StatusUnauthorized)
-		return
-	}
-	if _, err = r.Cookie("cerulean_token"); err != http.ErrNoCookie {
-		r.AddCookie(&http.Cookie{
-			Name:     "cerulean_token",
-			Value:    "",
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-			MaxAge:   1,
-		})
 	}
+	recordAuditEvent(r, document.Username, auditLogout, auditSuccess, "")
+	clearSessionCookie(w, r)
 	w.Write([]byte(`{"success":true}`))
 }
 
@@ -336,9 +570,6 @@ func changePasswordHandler(w http.ResponseWriter, r *http.Request, username stri
 	if err != nil || passwordData.NewPassword == "" || passwordData.CurrentPassword == "" {
 		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
 		return
-	} else if len(passwordData.NewPassword) < 8 {
-		http.Error(w, `{"error":"Minimum password length: 8"}`, http.StatusBadRequest)
-		return
 	}
 	result := database.Collection("users").FindOne(mongoCtx, bson.M{"username": username})
 	if result.Err() != nil {
@@ -352,55 +583,37 @@ func changePasswordHandler(w http.ResponseWriter, r *http.Request, username stri
 		log.Println(err)
 		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
 		return
-	} else if hashPassword(passwordData.CurrentPassword, user.Salt) != user.Password {
+	} else if ok, _ := verifyPassword(passwordData.CurrentPassword, user.Password, user.Salt); !ok {
+		recordAuditEvent(r, username, auditPasswordChange, auditFailure, "Invalid password")
 		http.Error(w, `{"error":"Invalid password!"}`, http.StatusUnauthorized)
 		return
 	}
-	saltBytes, err := generateToken()
+	reasons, err := checkPasswordPolicy(passwordData.NewPassword, user.Username, user.Email)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
 		return
-	}
-	salt := hex.EncodeToString(saltBytes)
-	updateResult, err := database.Collection("users").UpdateOne(
-		mongoCtx, bson.M{"username": username}, bson.M{"$set": bson.M{
-			"password": hashPassword(passwordData.NewPassword, salt), "salt": salt,
-		}},
-	)
-	if err != nil || updateResult.ModifiedCount != 1 {
-		log.Println(err, updateResult.ModifiedCount)
-		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
-		return
-	}
-	w.Write([]byte(`{"success":true}`))
-}
-
-func deleteAccountHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
-	if r.Method != "POST" {
-		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+	} else if reasons != nil {
+		writePasswordPolicyError(w, "newPassword", reasons)
 		return
 	}
-	result, err := database.Collection("users").DeleteOne(mongoCtx, bson.M{"username": username})
-	if err != nil || result.DeletedCount != 1 {
-		log.Println(err, result.DeletedCount)
+	passwordHash, err := hashPassword(passwordData.NewPassword)
+	if err != nil {
+		log.Println(err)
 		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
 		return
 	}
-	result, err = database.Collection("tokens").DeleteMany(mongoCtx, bson.M{"username": username})
-	if err != nil || result.DeletedCount <= 0 {
-		log.Println(err, result.DeletedCount)
+	updateResult, err := database.Collection("users").UpdateOne(
+		mongoCtx, bson.M{"username": username}, bson.M{
+			"$set":   bson.M{"password": passwordHash},
+			"$unset": bson.M{"salt": 1},
+		},
+	)
+	if err != nil || updateResult.ModifiedCount != 1 {
+		log.Println(err, updateResult.ModifiedCount)
 		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
 		return
 	}
-	if _, err = r.Cookie("cerulean_token"); err != http.ErrNoCookie {
-		r.AddCookie(&http.Cookie{
-			Name:     "cerulean_token",
-			Value:    "",
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-			MaxAge:   1,
-		})
-	}
+	recordAuditEvent(r, username, auditPasswordChange, auditSuccess, "")
 	w.Write([]byte(`{"success":true}`))
 }
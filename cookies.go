@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type CookieConfig struct {
+	Name     string   `json:"name"`
+	Domain   string   `json:"domain"`
+	Path     string   `json:"path"`
+	Secure   *bool    `json:"secure"`
+	SameSite string   `json:"sameSite"`
+	MaxAge   Duration `json:"maxAge"`
+}
+
+// setDefaults must be called after the session config's, since the cookie lasts as long as a session by default.
+func (c *CookieConfig) setDefaults() error {
+	if c.Name == "" {
+		c.Name = "cerulean_token"
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if c.Secure == nil {
+		secure := strings.HasPrefix(config.FrontendUrl, "https://")
+		c.Secure = &secure
+	}
+	if c.SameSite == "" {
+		c.SameSite = "lax"
+	} else if c.SameSite != "lax" && c.SameSite != "strict" && c.SameSite != "none" {
+		return fmt.Errorf("unknown cookie.sameSite: %s", c.SameSite)
+	} else if c.SameSite == "none" && !*c.Secure {
+		return fmt.Errorf("cookie.secure must be true when cookie.sameSite is none")
+	}
+	if c.MaxAge.Duration <= 0 {
+		c.MaxAge.Duration = config.Session.Lifetime.Duration
+	}
+	// Browsers reject cookies with these prefixes unless they follow these rules.
+	if strings.HasPrefix(c.Name, "__Host-") && (!*c.Secure || c.Domain != "" || c.Path != "/") {
+		return fmt.Errorf("cookie.name with the __Host- prefix requires cookie.secure, path / and no domain")
+	} else if strings.HasPrefix(c.Name, "__Secure-") && !*c.Secure {
+		return fmt.Errorf("cookie.name with the __Secure- prefix requires cookie.secure")
+	}
+	return nil
+}
+
+func (c *CookieConfig) sameSiteMode() http.SameSite {
+	switch c.SameSite {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+func sessionCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     config.Cookie.Name,
+		Value:    value,
+		Domain:   config.Cookie.Domain,
+		Path:     config.Cookie.Path,
+		Secure:   *config.Cookie.Secure,
+		HttpOnly: true,
+		SameSite: config.Cookie.sameSiteMode(),
+		MaxAge:   maxAge,
+	}
+}
+
+func setSessionCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, sessionCookie(token, int(config.Cookie.MaxAge.Seconds())))
+}
+
+// clearSessionCookie removes the session cookie, if the request has one.
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie(config.Cookie.Name); err == nil {
+		http.SetCookie(w, sessionCookie("", -1))
+	}
+}
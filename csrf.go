@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Requests authenticated with the session cookie are sent by browsers even when another site makes them,
+// so state-changing requests must come from an allowed origin and include the session's CSRF token in the
+// X-CSRF-Token header. The CSRF token is derived from the session, so it doesn't need to be stored, and other
+// sites can't read it. Requests using the Authorization header can't be forged, and aren't checked.
+
+type CSRFConfig struct {
+	AllowedOrigins []string `json:"allowedOrigins"`
+}
+
+func (c *CSRFConfig) setDefaults() error {
+	if len(c.AllowedOrigins) == 0 && config.FrontendUrl != "" {
+		c.AllowedOrigins = []string{config.FrontendUrl}
+	}
+	for i, origin := range c.AllowedOrigins {
+		parsed, err := url.Parse(origin)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("csrf.allowedOrigins has an invalid origin: %s", origin)
+		}
+		c.AllowedOrigins[i] = strings.ToLower(parsed.Scheme + "://" + parsed.Host)
+	}
+	return nil
+}
+
+// csrfToken returns the CSRF token for a session token. Access tokens use their session ID, so the CSRF token
+// stays the same when they are refreshed.
+func csrfToken(token string) string {
+	session := "token:" + hashToken(token)
+	if isAccessToken(token) {
+		if claims, err := verifyAccessToken(token); err == nil {
+			session = "session:" + claims.SessionID
+		}
+	}
+	mac := hmac.New(sha256.New, deriveKey("csrf"))
+	mac.Write([]byte(session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// requestOrigin returns the origin of a request from the Origin header, or the Referer if there is none.
+// Sandboxed pages send an Origin of "null", which is never allowed.
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return strings.ToLower(origin)
+	}
+	referer, err := url.Parse(r.Header.Get("Referer"))
+	if err != nil || referer.Scheme == "" || referer.Host == "" {
+		return ""
+	}
+	return strings.ToLower(referer.Scheme + "://" + referer.Host)
+}
+
+// checkCSRF checks a request authenticated with the session cookie, writing a 403 if it may be forged.
+func checkCSRF(w http.ResponseWriter, r *http.Request, token string) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+		return true
+	}
+	if origin := requestOrigin(r); origin != "" && !hasScope(config.CSRF.AllowedOrigins, origin) {
+		http.Error(w, `{"error":"Request origin is not allowed!"}`, http.StatusForbidden)
+		return false
+	}
+	header := r.Header.Get("X-CSRF-Token")
+	if header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(csrfToken(token))) != 1 {
+		http.Error(w, `{"error":"Invalid or missing CSRF token!"}`, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func getCSRFTokenHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	json.NewEncoder(w).Encode(map[string]string{"csrfToken": csrfToken(token)})
+}
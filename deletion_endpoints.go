@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Deleted accounts are kept for a grace period during which they can be restored, and then purged.
+
+type DeletionConfig struct {
+	GracePeriod   Duration `json:"gracePeriod"`
+	PurgeInterval Duration `json:"purgeInterval"`
+}
+
+func (c *DeletionConfig) setDefaults() error {
+	if c.GracePeriod.Duration < 0 {
+		return fmt.Errorf("deletion.gracePeriod must not be negative")
+	} else if c.GracePeriod.Duration == 0 {
+		c.GracePeriod.Duration = time.Hour * 24 * 30
+	}
+	if c.PurgeInterval.Duration <= 0 {
+		c.PurgeInterval.Duration = time.Hour
+	}
+	return nil
+}
+
+func sendAccountDeletedEmail(email string, username string, token string, deleteAfter time.Time) error {
+	link := config.FrontendUrl + "/restoreaccount?token=" + url.QueryEscape(token)
+	return mailer.SendMail(email, "Your Cerulean account will be deleted",
+		"Hi "+username+",\n\n"+
+			"Your Cerulean account has been scheduled for deletion, and will be permanently deleted on "+
+			deleteAfter.Format("2 January 2006")+". If you change your mind, you can restore it before then "+
+			"by opening the link below:\n\n"+
+			link+"\n")
+}
+
+type DeleteAccountData struct {
+	Password string `json:"password"`
+}
+
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var deleteData DeleteAccountData
+	err = json.Unmarshal(body, &deleteData)
+	if err != nil || deleteData.Password == "" {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var user UserDocument
+	err = database.Collection("users").FindOne(mongoCtx, bson.M{"username": username}).Decode(&user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if ok, _ := verifyPassword(deleteData.Password, user.Password, user.Salt); !ok {
+		recordAuditEvent(r, username, auditAccountDelete, auditFailure, "Invalid password")
+		http.Error(w, `{"error":"Invalid password!"}`, http.StatusUnauthorized)
+		return
+	}
+	restoreToken, err := generateVerifyToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	nowTime := time.Now().UTC()
+	deleteAfter := nowTime.Add(config.Deletion.GracePeriod.Duration)
+	_, err = database.Collection("users").UpdateOne(mongoCtx, bson.M{"username": username}, bson.M{"$set": bson.M{
+		"deletedAt":    nowTime,
+		"deleteAfter":  deleteAfter,
+		"restoreToken": hashToken(restoreToken),
+	}})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	// Log out everywhere. Other data is kept until the account is purged, so it can be restored.
+	_, err = database.Collection("tokens").DeleteMany(mongoCtx, bson.M{"username": username})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	_, err = database.Collection("api_keys").DeleteMany(mongoCtx, bson.M{"username": username})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	recordAuditEvent(r, username, auditAccountDelete, auditSuccess, "")
+	err = sendAccountDeletedEmail(user.Email, username, restoreToken, deleteAfter)
+	if err != nil {
+		log.Println(err)
+	}
+	clearSessionCookie(w, r)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "deleteAfter": deleteAfter})
+}
+
+type RestoreAccountData struct {
+	Token string `json:"token"`
+}
+
+func restoreAccountHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var restoreData RestoreAccountData
+	err = json.Unmarshal(body, &restoreData)
+	if err != nil || restoreData.Token == "" {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var user struct {
+		Username string `bson:"username"`
+	}
+	err = database.Collection("users").FindOneAndUpdate(
+		mongoCtx,
+		bson.M{"restoreToken": hashToken(restoreData.Token), "deleteAfter": bson.M{"$gt": time.Now().UTC()}},
+		bson.M{"$unset": bson.M{"deletedAt": 1, "deleteAfter": 1, "restoreToken": 1}},
+		options.FindOneAndUpdate().SetProjection(bson.M{"username": 1}),
+	).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, `{"error":"Invalid or expired restore token!"}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	recordAuditEvent(r, user.Username, auditAccountRestore, auditSuccess, "")
+	w.Write([]byte(`{"success":true}`))
+}
+
+// purgeUser permanently deletes a user whose grace period has ended and all of their data in a transaction.
+// It returns false without deleting anything if the account has been restored in the meantime.
+func purgeUser(username string) (bool, error) {
+	session, err := mongodb.StartSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.EndSession(context.Background())
+	purged, err := session.WithTransaction(context.Background(), func(ctx mongo.SessionContext) (interface{}, error) {
+		var user struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		err := database.Collection("users").FindOneAndDelete(
+			ctx,
+			bson.M{"username": username, "deleteAfter": bson.M{"$lte": time.Now().UTC()}},
+			options.FindOneAndDelete().SetProjection(bson.M{"_id": 1}),
+		).Decode(&user)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		// Tokens issued to the user's OAuth clients belong to other users, but are useless without the client.
+		clientIDs, err := database.Collection("oauth_clients").Distinct(ctx, "clientId", bson.M{"owner": username})
+		if err != nil {
+			return false, err
+		}
+		deletes := []struct {
+			collection string
+			filter     bson.M
+		}{
+			{"tokens", bson.M{"$or": bson.A{bson.M{"username": username}, bson.M{"clientId": bson.M{"$in": clientIDs}}}}},
+			{"api_keys", bson.M{"username": username}},
+			{"login_challenges", bson.M{"username": username}},
+			{"oauth_codes", bson.M{"$or": bson.A{bson.M{"username": username}, bson.M{"clientId": bson.M{"$in": clientIDs}}}}},
+			{"oauth_clients", bson.M{"owner": username}},
+			{"reserved_usernames", bson.M{"owner": username}},
+			{"audit_events", bson.M{"userId": user.ID}},
+			{"invites", bson.M{"createdBy": username}},
+		}
+		for _, d := range deletes {
+			_, err = database.Collection(d.collection).DeleteMany(ctx, d.filter)
+			if err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return purged.(bool), nil
+}
+
+// purgeDeletedUsers purges every user whose grace period has ended.
+func purgeDeletedUsers() (int, error) {
+	cursor, err := database.Collection("users").Find(
+		context.Background(),
+		bson.M{"deleteAfter": bson.M{"$lte": time.Now().UTC()}},
+		options.Find().SetProjection(bson.M{"username": 1}),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.Background())
+	purged := 0
+	for cursor.Next(context.Background()) {
+		var user struct {
+			Username string `bson:"username"`
+		}
+		err = cursor.Decode(&user)
+		if err != nil {
+			return purged, err
+		}
+		ok, err := purgeUser(user.Username)
+		if err != nil {
+			return purged, err
+		} else if ok {
+			purged++
+		}
+	}
+	return purged, cursor.Err()
+}
+
+func runDeletionPurger() {
+	for {
+		purged, err := purgeDeletedUsers()
+		if err != nil {
+			log.Println(err)
+		} else if purged > 0 {
+			infoLog.Printf("Purged %d deleted accounts.\n", purged)
+		}
+		time.Sleep(config.Deletion.PurgeInterval.Duration)
+	}
+}
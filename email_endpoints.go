@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const changeEmailLifetime = time.Hour * 24
+const revertEmailLifetime = time.Hour * 24 * 7
+
+var emailRegex = regexp.MustCompile(`^[a-zA-Z0-9_.+-]+@[a-zA-Z0-9-]+\.[a-zA-Z0-9-.]+$`)
+
+// emailInUseFilter matches users with an email, including users who can still revert a change away from it.
+func emailInUseFilter(email string) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"email": email},
+		bson.M{"previousEmail": email, "emailRevertExpiresAt": bson.M{"$gt": time.Now().UTC()}},
+	}}
+}
+
+func sendChangeEmailEmail(email string, username string, token string) error {
+	link := config.FrontendUrl + "/confirmemail?token=" + url.QueryEscape(token)
+	return mailer.SendMail(email, "Confirm your new Cerulean email",
+		"Hi "+username+",\n\n"+
+			"Please confirm you want to use this email for your Cerulean account by opening the link below:\n\n"+
+			link+"\n\n"+
+			"This link expires in 24 hours. If you did not request this change, you can ignore this email.\n")
+}
+
+func sendEmailChangedEmail(email string, username string, newEmail string, token string) error {
+	link := config.FrontendUrl + "/revertemail?token=" + url.QueryEscape(token)
+	return mailer.SendMail(email, "Your Cerulean email was changed",
+		"Hi "+username+",\n\n"+
+			"The email for your Cerulean account was changed to "+newEmail+".\n\n"+
+			"If this wasn't you, open the link below to change it back, log out of all devices and reset your password:\n\n"+
+			link+"\n\n"+
+			"This link expires in 7 days.\n")
+}
+
+func sendEmailRevertedEmail(email string, username string, token string) error {
+	link := config.FrontendUrl + "/resetpassword?token=" + url.QueryEscape(token)
+	return mailer.SendMail(email, "Choose a new Cerulean password",
+		"Hi "+username+",\n\n"+
+			"The email change on your Cerulean account was reverted, and you have been logged out of all devices. "+
+			"Whoever changed it may know your password, so it has been reset, and two-factor authentication and "+
+			"linked login providers have been removed. To choose a new password, open the link below:\n\n"+
+			link+"\n\n"+
+			"This link expires in 1 hour. After that, you can request another from the login page.\n")
+}
+
+type ChangeEmailData struct {
+	Password string `json:"password"`
+	NewEmail string `json:"newEmail"`
+}
+
+func changeEmailHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var emailData ChangeEmailData
+	err = json.Unmarshal(body, &emailData)
+	if err != nil || emailData.Password == "" || emailData.NewEmail == "" {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	} else if !emailRegex.MatchString(emailData.NewEmail) || len(emailData.NewEmail) > 254 {
+		http.Error(w, `{"error":"Invalid email provided!"}`, http.StatusBadRequest)
+		return
+	}
+	var user UserDocument
+	err = database.Collection("users").FindOne(mongoCtx, bson.M{"username": username}).Decode(&user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if ok, _ := verifyPassword(emailData.Password, user.Password, user.Salt); !ok {
+		http.Error(w, `{"error":"Invalid password!"}`, http.StatusUnauthorized)
+		return
+	} else if user.Email == emailData.NewEmail {
+		http.Error(w, `{"error":"This is already your email!"}`, http.StatusBadRequest)
+		return
+	} else if user.EmailRevertExpiresAt.After(time.Now().UTC()) {
+		// Otherwise the owner of the previous email would lose the ability to revert the last change.
+		http.Error(w, `{"error":"Your email was changed recently! Please try again later."}`, http.StatusConflict)
+		return
+	}
+	err = database.Collection("users").FindOne(mongoCtx, emailInUseFilter(emailData.NewEmail)).Err()
+	if err == nil {
+		http.Error(w, `{"error":"A user with this email already exists!"}`, http.StatusConflict)
+		return
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	changeToken, err := generateVerifyToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	// Requesting another change replaces the pending one, invalidating its link.
+	_, err = database.Collection("users").UpdateOne(mongoCtx, bson.M{"username": username}, bson.M{"$set": bson.M{
+		"pendingEmail":          emailData.NewEmail,
+		"pendingEmailToken":     hashToken(changeToken),
+		"pendingEmailExpiresAt": time.Now().UTC().Add(changeEmailLifetime),
+	}})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	err = sendChangeEmailEmail(emailData.NewEmail, username, changeToken)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Failed to send confirmation email!"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(`{"success":true}`))
+}
+
+type EmailTokenData struct {
+	Token string `json:"token"`
+}
+
+func confirmEmailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var tokenData EmailTokenData
+	err = json.Unmarshal(body, &tokenData)
+	if err != nil || tokenData.Token == "" {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var user UserDocument
+	nowTime := time.Now().UTC()
+	err = database.Collection("users").FindOne(mongoCtx, bson.M{
+		"pendingEmailToken": hashToken(tokenData.Token), "pendingEmailExpiresAt": bson.M{"$gt": nowTime},
+	}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, `{"error":"Invalid or expired email confirmation token!"}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	// Someone else may have registered with the email since the change was requested.
+	err = database.Collection("users").FindOne(mongoCtx, emailInUseFilter(user.PendingEmail)).Err()
+	if err == nil {
+		http.Error(w, `{"error":"A user with this email already exists!"}`, http.StatusConflict)
+		return
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	revertToken, err := generateVerifyToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	// Confirming the new email also verifies the account, since the user has proven they own the email. Any
+	// password reset link sent to the old email stops working.
+	updateResult, err := database.Collection("users").UpdateOne(
+		mongoCtx,
+		bson.M{"username": user.Username, "pendingEmailToken": hashToken(tokenData.Token)},
+		bson.M{
+			"$set": bson.M{
+				"email":                user.PendingEmail,
+				"verified":             "",
+				"previousEmail":        user.Email,
+				"emailRevertToken":     hashToken(revertToken),
+				"emailRevertExpiresAt": nowTime.Add(revertEmailLifetime),
+			},
+			"$unset": bson.M{
+				"pendingEmail":           1,
+				"pendingEmailToken":      1,
+				"pendingEmailExpiresAt":  1,
+				"verifyExpiresAt":        1,
+				"verifySentAt":           1,
+				"passwordReset":          1,
+				"passwordResetExpiresAt": 1,
+			},
+		},
+	)
+	if field := duplicateUserField(err); field != "" {
+		writeDuplicateUserError(w, field)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if updateResult.ModifiedCount != 1 {
+		http.Error(w, `{"error":"Invalid or expired email confirmation token!"}`, http.StatusBadRequest)
+		return
+	}
+	err = sendEmailChangedEmail(user.Email, user.Username, user.PendingEmail, revertToken)
+	if err != nil {
+		log.Println(err)
+	}
+	w.Write([]byte(`{"success":true}`))
+}
+
+func revertEmailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var tokenData EmailTokenData
+	err = json.Unmarshal(body, &tokenData)
+	if err != nil || tokenData.Token == "" {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	// Whoever changed the email may have also changed the password, enabled two-factor authentication or linked
+	// a login provider with their email, so the password is replaced with a random one which the user must reset,
+	// and the rest is removed.
+	passwordBytes, err := generateToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	passwordHash, err := hashPassword(hex.EncodeToString(passwordBytes))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	resetBytes, err := generateToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	resetToken := hex.EncodeToString(resetBytes)
+	// The email is restored with a pipeline update, since it has to be copied from previousEmail. Other values
+	// are wrapped in $literal, since password hashes start with $ and would be read as a field path.
+	var user UserDocument
+	nowTime := time.Now().UTC()
+	after := options.After
+	err = database.Collection("users").FindOneAndUpdate(
+		mongoCtx,
+		bson.M{"emailRevertToken": hashToken(tokenData.Token), "emailRevertExpiresAt": bson.M{"$gt": nowTime}},
+		bson.A{
+			bson.M{"$set": bson.M{
+				"email":                  "$previousEmail",
+				"password":               bson.M{"$literal": passwordHash},
+				"passwordReset":          bson.M{"$literal": hashToken(resetToken)},
+				"passwordResetExpiresAt": bson.M{"$literal": nowTime.Add(passwordResetLifetime)},
+				"passwordResetSentAt":    bson.M{"$literal": nowTime},
+			}},
+			bson.M{"$unset": bson.A{
+				"previousEmail", "emailRevertToken", "emailRevertExpiresAt",
+				"pendingEmail", "pendingEmailToken", "pendingEmailExpiresAt",
+				"salt", "totpSecret", "totpPendingSecret", "totpLastCounter", "recoveryCodes", "oidcIdentities",
+			}},
+		},
+		&options.FindOneAndUpdateOptions{ReturnDocument: &after},
+	).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, `{"error":"Invalid or expired email revert token!"}`, http.StatusBadRequest)
+		return
+	} else if field := duplicateUserField(err); field != "" {
+		writeDuplicateUserError(w, field)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	// Whoever changed the email may still be logged in, so log out of all devices and revoke everything they
+	// could have given access to. Tokens issued to OAuth clients are stored with the user's sessions.
+	err = revokeUserSessions(user.Username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	for _, collection := range []string{"api_keys", "oauth_codes"} {
+		_, err = database.Collection(collection).DeleteMany(mongoCtx, bson.M{"username": user.Username})
+		if err != nil {
+			log.Println(err)
+			http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	recordAuditEvent(r, user.Username, auditTokenRevoke, auditSuccess,
+		"All sessions, API keys and OAuth authorizations, email change reverted")
+	recordAuditEvent(r, user.Username, auditPasswordReset, auditSuccess, "Required after email change reverted")
+	err = sendEmailRevertedEmail(user.Email, user.Username, resetToken)
+	if err != nil {
+		log.Println(err)
+	}
+	w.Write([]byte(`{"success":true}`))
+}
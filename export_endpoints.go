@@ -0,0 +1,402 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The export is a zip archive with a JSON and a CSV file for each kind of data. Each file is written straight
+// from a database cursor, so only one record is held in memory at a time.
+
+type ExportProfileData struct {
+	Username         string         `json:"username"`
+	Email            string         `json:"email"`
+	Verified         bool           `json:"verified"`
+	PendingEmail     string         `json:"pendingEmail,omitempty"`
+	Role             string         `json:"role"`
+	Disabled         bool           `json:"disabled"`
+	SuspendedUntil   *time.Time     `json:"suspendedUntil"`
+	SuspensionReason string         `json:"suspensionReason,omitempty"`
+	SuspendedBy      string         `json:"suspendedBy,omitempty"`
+	TwoFactorEnabled bool           `json:"twoFactorEnabled"`
+	OIDCIdentities   []OIDCIdentity `json:"oidcIdentities"`
+	LastEdited       time.Time      `json:"lastEdited"`
+}
+
+type ExportTodoData struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Done        bool       `json:"done"`
+	Repeating   string     `json:"repeating"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	DueDate     *time.Time `json:"dueDate"`
+}
+
+type ExportSessionData struct {
+	ID         string    `json:"id"`
+	ClientID   string    `json:"clientId,omitempty"`
+	Scopes     []string  `json:"scopes,omitempty"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	IssuedOn   time.Time `json:"issuedOn"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// exportSection is one kind of data in the export, written as <name>.json and <name>.csv.
+type exportSection struct {
+	name   string
+	header []string
+	query  func() (*mongo.Cursor, error)
+	record func(cursor *mongo.Cursor) (interface{}, []string, error)
+}
+
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// escapeCSVRow stops spreadsheets from running cells as formulas, by prefixing cells which start with a
+// character that begins a formula with a quote.
+func escapeCSVRow(row []string) []string {
+	escaped := make([]string, len(row))
+	for i, cell := range row {
+		if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+			cell = "'" + cell
+		}
+		escaped[i] = cell
+	}
+	return escaped
+}
+
+func exportSections(username string) []exportSection {
+	return []exportSection{
+		{
+			name:   "todos",
+			header: []string{"id", "name", "description", "done", "repeating", "createdAt", "updatedAt", "dueDate"},
+			query: func() (*mongo.Cursor, error) {
+				return database.Collection("users").Aggregate(mongoCtx, bson.A{
+					bson.M{"$match": bson.M{"username": username}},
+					bson.M{"$unwind": "$todos"},
+					bson.M{"$replaceRoot": bson.M{"newRoot": "$todos"}},
+				})
+			},
+			record: func(cursor *mongo.Cursor) (interface{}, []string, error) {
+				var todo TodoDocument
+				err := cursor.Decode(&todo)
+				if err != nil {
+					return nil, nil, err
+				}
+				data := ExportTodoData{
+					ID:          todo.ID.Hex(),
+					Name:        todo.Name,
+					Description: todo.Description,
+					Done:        todo.Done,
+					Repeating:   todo.Repeating,
+					CreatedAt:   todo.CreatedAt,
+					UpdatedAt:   todo.UpdatedAt,
+				}
+				if !todo.DueDate.IsZero() {
+					data.DueDate = &todo.DueDate
+				}
+				return data, []string{
+					data.ID, data.Name, data.Description, strconv.FormatBool(data.Done), data.Repeating,
+					formatExportTime(data.CreatedAt), formatExportTime(data.UpdatedAt), formatExportTime(todo.DueDate),
+				}, nil
+			},
+		},
+		{
+			name:   "sessions",
+			header: []string{"id", "clientId", "scopes", "userAgent", "ip", "issuedOn", "lastUsedAt", "expiresAt"},
+			query: func() (*mongo.Cursor, error) {
+				return database.Collection("tokens").Find(
+					mongoCtx, bson.M{"username": username}, options.Find().SetSort(bson.M{"issuedOn": -1}),
+				)
+			},
+			record: func(cursor *mongo.Cursor) (interface{}, []string, error) {
+				var document TokenDocument
+				err := cursor.Decode(&document)
+				if err != nil {
+					return nil, nil, err
+				}
+				data := ExportSessionData{
+					ID:         document.ID.Hex(),
+					ClientID:   document.ClientID,
+					Scopes:     document.Scopes,
+					UserAgent:  document.UserAgent,
+					IP:         document.IP,
+					IssuedOn:   document.IssuedOn,
+					LastUsedAt: document.LastUsedAt,
+					ExpiresAt:  document.ExpiresAt,
+				}
+				return data, []string{
+					data.ID, data.ClientID, strings.Join(data.Scopes, " "), data.UserAgent, data.IP,
+					formatExportTime(data.IssuedOn), formatExportTime(data.LastUsedAt), formatExportTime(data.ExpiresAt),
+				}, nil
+			},
+		},
+		{
+			name:   "apikeys",
+			header: []string{"id", "name", "scopes", "createdAt", "expiresAt", "lastUsedAt"},
+			query: func() (*mongo.Cursor, error) {
+				return database.Collection("api_keys").Find(
+					mongoCtx, bson.M{"username": username}, options.Find().SetSort(bson.M{"createdAt": -1}),
+				)
+			},
+			record: func(cursor *mongo.Cursor) (interface{}, []string, error) {
+				var document APIKeyDocument
+				err := cursor.Decode(&document)
+				if err != nil {
+					return nil, nil, err
+				}
+				data := APIKeyData{
+					ID:        document.ID.Hex(),
+					Name:      document.Name,
+					Scopes:    document.Scopes,
+					CreatedAt: document.CreatedAt,
+					ExpiresAt: document.ExpiresAt,
+				}
+				if !document.LastUsedAt.IsZero() {
+					data.LastUsedAt = &document.LastUsedAt
+				}
+				return data, []string{
+					data.ID, data.Name, strings.Join(data.Scopes, " "), formatExportTime(data.CreatedAt),
+					formatExportTime(data.ExpiresAt), formatExportTime(document.LastUsedAt),
+				}, nil
+			},
+		},
+		{
+			name:   "oauthclients",
+			header: []string{"clientId", "name", "redirectUris", "confidential", "createdAt"},
+			query: func() (*mongo.Cursor, error) {
+				return database.Collection("oauth_clients").Find(
+					mongoCtx, bson.M{"owner": username}, options.Find().SetSort(bson.M{"createdAt": -1}),
+				)
+			},
+			record: func(cursor *mongo.Cursor) (interface{}, []string, error) {
+				var document OAuthClientDocument
+				err := cursor.Decode(&document)
+				if err != nil {
+					return nil, nil, err
+				}
+				data := OAuthClientData{
+					ClientID:     document.ClientID,
+					Name:         document.Name,
+					RedirectURIs: document.RedirectURIs,
+					Confidential: document.Secret != "",
+					CreatedAt:    document.CreatedAt,
+				}
+				return data, []string{
+					data.ClientID, data.Name, strings.Join(data.RedirectURIs, " "),
+					strconv.FormatBool(data.Confidential), formatExportTime(data.CreatedAt),
+				}, nil
+			},
+		},
+		{
+			name:   "invites",
+			header: []string{"id", "maxUses", "uses", "usedBy", "createdAt", "expiresAt"},
+			query: func() (*mongo.Cursor, error) {
+				return database.Collection("invites").Find(
+					mongoCtx, bson.M{"createdBy": username}, options.Find().SetSort(bson.M{"createdAt": -1}),
+				)
+			},
+			record: func(cursor *mongo.Cursor) (interface{}, []string, error) {
+				var document InviteDocument
+				err := cursor.Decode(&document)
+				if err != nil {
+					return nil, nil, err
+				}
+				data := inviteData(document)
+				return data, []string{
+					data.ID, strconv.Itoa(data.MaxUses), strconv.Itoa(data.Uses), strings.Join(data.UsedBy, " "),
+					formatExportTime(data.CreatedAt), formatExportTime(data.ExpiresAt),
+				}, nil
+			},
+		},
+		{
+			name:   "auditlog",
+			header: []string{"id", "event", "outcome", "details", "ip", "userAgent", "createdAt"},
+			query: func() (*mongo.Cursor, error) {
+				id, err := userID(mongoCtx, username)
+				if err != nil {
+					return nil, err
+				}
+				return database.Collection("audit_events").Find(
+					mongoCtx, bson.M{"userId": id}, options.Find().SetSort(bson.M{"createdAt": -1}),
+				)
+			},
+			record: func(cursor *mongo.Cursor) (interface{}, []string, error) {
+				var document AuditEventDocument
+				err := cursor.Decode(&document)
+				if err != nil {
+					return nil, nil, err
+				}
+				data := auditEventData(document)
+				return data, []string{
+					data.ID, data.Event, data.Outcome, data.Details, data.IP, data.UserAgent,
+					formatExportTime(data.CreatedAt),
+				}, nil
+			},
+		},
+	}
+}
+
+func writeExportSection(archive *zip.Writer, section exportSection) error {
+	file, err := archive.Create(section.name + ".json")
+	if err != nil {
+		return err
+	}
+	cursor, err := section.query()
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(mongoCtx)
+	file.Write([]byte("["))
+	encoder := json.NewEncoder(file)
+	for first := true; cursor.Next(mongoCtx); first = false {
+		value, _, err := section.record(cursor)
+		if err != nil {
+			return err
+		} else if !first {
+			file.Write([]byte(","))
+		}
+		err = encoder.Encode(value)
+		if err != nil {
+			return err
+		}
+	}
+	if cursor.Err() != nil {
+		return cursor.Err()
+	}
+	_, err = file.Write([]byte("]\n"))
+	if err != nil {
+		return err
+	}
+
+	file, err = archive.Create(section.name + ".csv")
+	if err != nil {
+		return err
+	}
+	cursor, err = section.query()
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(mongoCtx)
+	writer := csv.NewWriter(file)
+	writer.Write(section.header)
+	for cursor.Next(mongoCtx) {
+		_, row, err := section.record(cursor)
+		if err != nil {
+			return err
+		}
+		writer.Write(escapeCSVRow(row))
+	}
+	writer.Flush()
+	if cursor.Err() != nil {
+		return cursor.Err()
+	}
+	return writer.Error()
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	var user UserDocument
+	err := database.Collection("users").FindOne(
+		mongoCtx, bson.M{"username": username}, options.FindOne().SetProjection(bson.M{"todos": 0}),
+	).Decode(&user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	profile := ExportProfileData{
+		Username:         user.Username,
+		Email:            user.Email,
+		Verified:         user.Verified == "",
+		PendingEmail:     user.PendingEmail,
+		Role:             user.Role,
+		Disabled:         user.Disabled,
+		SuspensionReason: user.SuspensionReason,
+		SuspendedBy:      user.SuspendedBy,
+		TwoFactorEnabled: user.TOTPSecret != "",
+		OIDCIdentities:   user.OIDCIdentities,
+		LastEdited:       user.LastEdited,
+	}
+	if profile.Role == "" {
+		profile.Role = roleUser
+	}
+	if !user.SuspendedUntil.IsZero() {
+		profile.SuspendedUntil = &user.SuspendedUntil
+	}
+	if profile.OIDCIdentities == nil {
+		profile.OIDCIdentities = []OIDCIdentity{}
+	}
+
+	nowTime := time.Now().UTC()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="cerulean-export-`+username+"-"+nowTime.Format("2006-01-02")+`.zip"`)
+	// Once the archive has started streaming, errors can only be reported by cutting it short.
+	archive := zip.NewWriter(w)
+	file, err := archive.Create("profile.json")
+	if err == nil {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(profile)
+	}
+	if err == nil {
+		file, err = archive.Create("profile.csv")
+	}
+	if err == nil {
+		rows := [][]string{
+			{"field", "value"},
+			{"username", profile.Username},
+			{"email", profile.Email},
+			{"verified", strconv.FormatBool(profile.Verified)},
+			{"pendingEmail", profile.PendingEmail},
+			{"role", profile.Role},
+			{"disabled", strconv.FormatBool(profile.Disabled)},
+			{"suspendedUntil", formatExportTime(user.SuspendedUntil)},
+			{"suspensionReason", profile.SuspensionReason},
+			{"suspendedBy", profile.SuspendedBy},
+			{"twoFactorEnabled", strconv.FormatBool(profile.TwoFactorEnabled)},
+			{"lastEdited", formatExportTime(profile.LastEdited)},
+		}
+		for _, identity := range profile.OIDCIdentities {
+			rows = append(rows, []string{"oidcIdentity", identity.Provider + ":" + identity.Subject})
+		}
+		writer := csv.NewWriter(file)
+		for _, row := range rows {
+			writer.Write(escapeCSVRow(row))
+		}
+		writer.Flush()
+		err = writer.Error()
+	}
+	for _, section := range exportSections(username) {
+		if err != nil {
+			break
+		}
+		err = writeExportSection(archive, section)
+	}
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = archive.Close()
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Failed logins are counted per username and per client IP. After a number of free attempts, each failure
+// locks the key for twice as long as the last one, up to loginMaxLockout.
+
+const loginFreeAttemptsPerUser = 5
+const loginFreeAttemptsPerIP = 20
+const loginMaxLockout = time.Minute * 15
+const loginAttemptsWindow = time.Hour * 24
+
+func loginAttemptKeys(r *http.Request, username string) []string {
+	return []string{loginUserKey(username), "ip:" + clientIP(r)}
+}
+
+func loginUserKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+// checkLoginLockout returns when the first of the given keys to be locked is unlocked, or a zero time, and
+// the most failures recorded for any of the keys.
+func checkLoginLockout(keys []string) (time.Time, int, error) {
+	nowTime := time.Now().UTC()
+	// Expired attempts are removed by the TTL index on expiresAt, which only runs periodically.
+	cursor, err := database.Collection("login_attempts").Find(mongoCtx, bson.M{
+		"key": bson.M{"$in": keys}, "expiresAt": bson.M{"$gt": nowTime},
+	})
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	var documents []LoginAttemptDocument
+	err = cursor.All(mongoCtx, &documents)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	var lockedUntil time.Time
+	failures := 0
+	for _, document := range documents {
+		if document.LockedUntil.After(lockedUntil) && document.LockedUntil.After(nowTime) {
+			lockedUntil = document.LockedUntil
+		}
+		if document.Failures > failures {
+			failures = document.Failures
+		}
+	}
+	return lockedUntil, failures, nil
+}
+
+// recordLoginFailure increments the failure counters for the given keys and locks them if necessary.
+func recordLoginFailure(keys []string) (time.Time, error) {
+	var lockedUntil time.Time
+	nowTime := time.Now().UTC()
+	after := options.After
+	upsert := true
+	for _, key := range keys {
+		var document LoginAttemptDocument
+		err := database.Collection("login_attempts").FindOneAndUpdate(
+			mongoCtx,
+			bson.M{"key": key},
+			bson.M{
+				"$inc": bson.M{"failures": 1},
+				"$set": bson.M{"lastFailureAt": nowTime, "expiresAt": nowTime.Add(loginAttemptsWindow)},
+			},
+			&options.FindOneAndUpdateOptions{ReturnDocument: &after, Upsert: &upsert},
+		).Decode(&document)
+		if err != nil {
+			return lockedUntil, err
+		}
+		freeAttempts := loginFreeAttemptsPerUser
+		if strings.HasPrefix(key, "ip:") {
+			freeAttempts = loginFreeAttemptsPerIP
+		}
+		if document.Failures < freeAttempts {
+			continue
+		}
+		lockout := loginMaxLockout
+		if shift := document.Failures - freeAttempts; shift < 20 && time.Second<<shift < loginMaxLockout {
+			lockout = time.Second << shift
+		}
+		_, err = database.Collection("login_attempts").UpdateOne(
+			mongoCtx, bson.M{"_id": document.ID}, bson.M{"$set": bson.M{"lockedUntil": nowTime.Add(lockout)}},
+		)
+		if err != nil {
+			return lockedUntil, err
+		}
+		if nowTime.Add(lockout).After(lockedUntil) {
+			lockedUntil = nowTime.Add(lockout)
+		}
+	}
+	return lockedUntil, nil
+}
+
+// resetLoginFailures clears the failures for a username after a successful login. Failures for the IP address
+// are left to expire, so logging into another account can't be used to reset them between guesses.
+func resetLoginFailures(username string) error {
+	_, err := database.Collection("login_attempts").DeleteOne(mongoCtx, bson.M{"key": loginUserKey(username)})
+	return err
+}
+
+func writeLoginLockout(w http.ResponseWriter, lockedUntil time.Time) {
+	retryAfter := int(time.Until(lockedUntil).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, fmt.Sprintf(
+		`{"error":"Too many failed login attempts! Try again in %d seconds.","retryAfter":%d}`, retryAfter, retryAfter,
+	), http.StatusTooManyRequests)
+}
+
+type LockoutData struct {
+	ID            string    `json:"id"`
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"lastFailureAt"`
+	LockedUntil   time.Time `json:"lockedUntil"`
+}
+
+func getLockoutsHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	cursor, err := database.Collection("login_attempts").Find(
+		mongoCtx,
+		bson.M{"lockedUntil": bson.M{"$gt": time.Now().UTC()}},
+		options.Find().SetSort(bson.M{"lockedUntil": -1}).SetLimit(1000),
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	var documents []LoginAttemptDocument
+	err = cursor.All(mongoCtx, &documents)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	lockouts := make([]LockoutData, 0, len(documents))
+	for _, document := range documents {
+		lockouts = append(lockouts, LockoutData{
+			ID:            document.ID.Hex(),
+			Key:           document.Key,
+			Failures:      document.Failures,
+			LastFailureAt: document.LastFailureAt,
+			LockedUntil:   document.LockedUntil,
+		})
+	}
+	json.NewEncoder(w).Encode(struct {
+		Lockouts []LockoutData `json:"lockouts"`
+	}{Lockouts: lockouts})
+}
+
+func deleteLockoutHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	pathSegments := strings.Split(r.URL.Path, "/")[3:]
+	if len(pathSegments) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(pathSegments[0])
+	if err != nil {
+		http.Error(w, `{"error":"Lockout not found!"}`, http.StatusNotFound)
+		return
+	}
+	var document LoginAttemptDocument
+	err = database.Collection("login_attempts").FindOneAndDelete(mongoCtx, bson.M{"_id": id}).Decode(&document)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, `{"error":"Lockout not found!"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	infoLog.Printf("%s cleared the login lockout for %s.\n", username, document.Key)
+	w.Write([]byte(`{"success":true}`))
+}
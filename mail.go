@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EmailConfig struct {
+	Mailer       string `json:"mailer"`
+	From         string `json:"from"`
+	SmtpHost     string `json:"smtpHost"`
+	SmtpPort     int    `json:"smtpPort"`
+	SmtpUsername string `json:"smtpUsername"`
+	SmtpPassword string `json:"smtpPassword"`
+	File         string `json:"file"`
+}
+
+// Mailer is implemented by everything that can deliver emails to users.
+type Mailer interface {
+	SendMail(to string, subject string, body string) error
+}
+
+var mailer Mailer
+
+func newMailer(config EmailConfig) (Mailer, error) {
+	switch config.Mailer {
+	case "smtp":
+		if config.SmtpHost == "" || config.From == "" {
+			return nil, fmt.Errorf("smtp mailer requires smtpHost and from to be set")
+		}
+		return &smtpMailer{config: config}, nil
+	case "file", "log", "":
+		return &fileMailer{path: config.File}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer: %s", config.Mailer)
+	}
+}
+
+func formatMail(from string, to string, subject string, body string) []byte {
+	return []byte("From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().UTC().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n"))
+}
+
+type smtpMailer struct {
+	config EmailConfig
+}
+
+func (m *smtpMailer) SendMail(to string, subject string, body string) error {
+	port := m.config.SmtpPort
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if m.config.SmtpUsername != "" {
+		auth = smtp.PlainAuth("", m.config.SmtpUsername, m.config.SmtpPassword, m.config.SmtpHost)
+	}
+	addr := fmt.Sprintf("%s:%d", m.config.SmtpHost, port)
+	return smtp.SendMail(addr, auth, m.config.From, []string{to}, formatMail(m.config.From, to, subject, body))
+}
+
+// fileMailer appends emails to a file, or logs them if no file is set. Useful for testing.
+type fileMailer struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func (m *fileMailer) SendMail(to string, subject string, body string) error {
+	if m.path == "" {
+		infoLog.Printf("Email to %s with subject \"%s\":\n%s\n", to, subject, body)
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	file, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(formatMail("cerulean", to, subject, body), []byte("\r\n\r\n")...))
+	return err
+}
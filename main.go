@@ -5,12 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gorilla/handlers"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -21,8 +22,51 @@ var database *mongo.Database
 var mongoCtx context.Context
 
 type Config struct {
-	Port     int    `json:"port"`
-	MongoUri string `json:"mongoUri"`
+	Port         int                  `json:"port"`
+	MongoUri     string               `json:"mongoUri"`
+	FrontendUrl  string               `json:"frontendUrl"`
+	TrustProxy   bool                 `json:"trustProxy"`
+	Secret       string               `json:"secret"`
+	Admins       []string             `json:"admins"`
+	Email        EmailConfig          `json:"email"`
+	Session      SessionConfig        `json:"session"`
+	OIDC         []OIDCProviderConfig `json:"oidc"`
+	RateLimit    RateLimitConfig      `json:"rateLimit"`
+	Password     PasswordConfig       `json:"password"`
+	Deletion     DeletionConfig       `json:"deletion"`
+	Audit        AuditConfig          `json:"audit"`
+	CSRF         CSRFConfig           `json:"csrf"`
+	Cookie       CookieConfig         `json:"cookie"`
+	Registration RegistrationConfig   `json:"registration"`
+	ProofOfWork  ProofOfWorkConfig    `json:"proofOfWork"`
+}
+
+// Duration is a time.Duration which is written in config.json as a string e.g. "720h" or "15m".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	d.Duration, err = time.ParseDuration(value)
+	return err
+}
+
+// clientIP returns the IP address of the client, taking X-Forwarded-For into account if behind a proxy.
+func clientIP(r *http.Request) string {
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); config.TrustProxy && forwardedFor != "" {
+		ips := strings.Split(forwardedFor, ",")
+		return strings.TrimSpace(ips[len(ips)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 var infoLog = log.New(os.Stdout, "info: ", log.Ldate|log.Ltime)
@@ -40,14 +84,78 @@ func main() {
 	if err != nil {
 		log.Panicln(err)
 	}
+	err = config.Session.setDefaults()
+	if err != nil {
+		log.Panicln(err)
+	}
+	err = setOIDCDefaults(config.OIDC)
+	if err != nil {
+		log.Panicln(err)
+	}
+	err = config.RateLimit.setDefaults()
+	if err != nil {
+		log.Panicln(err)
+	}
+	err = config.Password.setDefaults()
+	if err != nil {
+		log.Panicln(err)
+	}
+	err = config.Deletion.setDefaults()
+	if err != nil {
+		log.Panicln(err)
+	}
+	err = config.Audit.setDefaults()
+	if err != nil {
+		log.Panicln(err)
+	}
+	err = config.CSRF.setDefaults()
+	if err != nil {
+		log.Panicln(err)
+	}
+	err = config.Cookie.setDefaults()
+	if err != nil {
+		log.Panicln(err)
+	}
+	err = config.Registration.setDefaults()
+	if err != nil {
+		log.Panicln(err)
+	}
+	err = config.ProofOfWork.setDefaults()
+	if err != nil {
+		log.Panicln(err)
+	}
+	if config.Password.BreachedFile != "" {
+		breachedPasswords, err = openBreachedPasswordList(config.Password.BreachedFile)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+	secretKey = []byte(config.Secret)
+	if len(secretKey) == 0 {
+		secretKey, err = generateToken()
+		if err != nil {
+			log.Panicln(err)
+		}
+		log.Println("No secret in config.json, signed tokens will become invalid when the server restarts.")
+	}
+	mailer, err = newMailer(config.Email)
+	if err != nil {
+		log.Panicln(err)
+	}
+	rateLimitStore, err = newRateLimitStore(config.RateLimit)
+	if err != nil {
+		log.Panicln(err)
+	}
 
-	// Connect to MongoDB.
-	mongoCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Connect to MongoDB. Only connecting has a timeout, since migrations and index builds can take a while on
+	// large databases. They are safe to interrupt, and pick up where they left off when the server restarts.
+	connectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	mongodb, err = mongo.Connect(mongoCtx, options.Client().ApplyURI(config.MongoUri))
+	mongodb, err = mongo.Connect(connectCtx, options.Client().ApplyURI(config.MongoUri))
 	if err != nil {
 		log.Panicln(err)
 	}
+	mongoCtx = context.Background()
 	defer func() {
 		if err = mongodb.Disconnect(mongoCtx); err != nil {
 			log.Panicln(err)
@@ -56,30 +164,146 @@ func main() {
 
 	// Define MongoDB schemas.
 	database = mongodb.Database("cerulean")
-	database.CreateCollection(mongoCtx, "users", &options.CreateCollectionOptions{
-		Validator: bson.M{"$jsonSchema": UsersCollectionSchema},
-	})
-	database.CreateCollection(mongoCtx, "tokens", &options.CreateCollectionOptions{
-		Validator: bson.M{"$jsonSchema": TokensCollectionSchema},
-	})
+	if err = applySchema(mongoCtx, "users", UsersCollectionSchema); err != nil {
+		log.Println(err)
+	}
+	if err = applySchema(mongoCtx, "tokens", TokensCollectionSchema); err != nil {
+		log.Println(err)
+	}
+	if err = applySchema(mongoCtx, "login_challenges", LoginChallengesCollectionSchema); err != nil {
+		log.Println(err)
+	}
+	if err = applySchema(mongoCtx, "api_keys", APIKeysCollectionSchema); err != nil {
+		log.Println(err)
+	}
+	if err = applySchema(mongoCtx, "oauth_clients", OAuthClientsCollectionSchema); err != nil {
+		log.Println(err)
+	}
+	if err = applySchema(mongoCtx, "oauth_codes", OAuthCodesCollectionSchema); err != nil {
+		log.Println(err)
+	}
+	if err = applySchema(mongoCtx, "oidc_states", OIDCStatesCollectionSchema); err != nil {
+		log.Println(err)
+	}
+	if err = applySchema(mongoCtx, "login_attempts", LoginAttemptsCollectionSchema); err != nil {
+		log.Println(err)
+	}
+	if err = applySchema(mongoCtx, "rate_limits", RateLimitsCollectionSchema); err != nil {
+		log.Println(err)
+	}
+	if err = applySchema(mongoCtx, "reserved_usernames", ReservedUsernamesCollectionSchema); err != nil {
+		log.Println(err)
+	}
+	if err = applySchema(mongoCtx, "audit_events", AuditEventsCollectionSchema); err != nil {
+		log.Println(err)
+	}
+	if err = applySchema(mongoCtx, "invites", InvitesCollectionSchema); err != nil {
+		log.Println(err)
+	}
+	if err = applySchema(mongoCtx, "used_challenges", UsedChallengesCollectionSchema); err != nil {
+		log.Println(err)
+	}
+	if err = applySchema(mongoCtx, "admin_promotions", AdminPromotionsCollectionSchema); err != nil {
+		log.Println(err)
+	}
 	infoLog.Println("Successfully connected to MongoDB.")
 
-	// Create CORS handler wrapper.
-	cors := handlers.CORS(
-		handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "Accept"}),
+	// Run migrations.
+	migrated, err := migrateHashedTokens(mongoCtx)
+	if err != nil {
+		log.Panicln(err)
+	} else if migrated > 0 {
+		infoLog.Printf("Migrated %d plaintext tokens to hashed tokens.\n", migrated)
+	}
+	migrated, err = migrateTokenExpiry(mongoCtx)
+	if err != nil {
+		log.Panicln(err)
+	} else if migrated > 0 {
+		infoLog.Printf("Set expiry on %d tokens.\n", migrated)
+	}
+	if err = createIndexes(mongoCtx); err != nil {
+		log.Panicln(err)
+	}
+	if err = promoteAdmins(config.Admins); err != nil {
+		log.Panicln(err)
+	}
+	go runDeletionPurger()
+
+	// Create CORS handler wrapper. Origins allowed to use the session cookie can send credentials, which
+	// browsers don't allow with a wildcard origin.
+	corsOptions := []handlers.CORSOption{
+		handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "Accept", "X-CSRF-Token"}),
 		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "HEAD", "OPTIONS", "PATCH", "DELETE"}),
-		handlers.AllowedOrigins([]string{"*"}),
-	)
+		handlers.ExposedHeaders([]string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After"}),
+	}
+	publicCors := handlers.CORS(append(corsOptions, handlers.AllowedOrigins([]string{"*"}))...)
+	credentialsCors := handlers.CORS(append(corsOptions,
+		handlers.AllowedOrigins(config.CSRF.AllowedOrigins), handlers.AllowCredentials())...)
+	cors := func(handler http.Handler) http.Handler {
+		public, credentials := publicCors(handler), credentialsCors(handler)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+			if hasScope(config.CSRF.AllowedOrigins, strings.ToLower(r.Header.Get("Origin"))) {
+				credentials.ServeHTTP(w, r)
+			} else {
+				public.ServeHTTP(w, r)
+			}
+		})
+	}
 	// Authentication endpoints.
-	http.Handle("/login", cors(http.HandlerFunc(loginHandler)))
-	http.Handle("/logout", cors(http.HandlerFunc(logoutHandler)))
-	http.Handle("/register", cors(http.HandlerFunc(registerHandler)))
-	http.Handle("/deleteaccount", cors(http.HandlerFunc(handleLoginCheck(deleteAccountHandler, []string{"POST"}))))
-	http.Handle("/changepassword", cors(http.HandlerFunc(handleLoginCheck(changePasswordHandler, []string{"POST"}))))
+	http.Handle("/login", cors(rateLimit("/login", http.HandlerFunc(loginHandler))))
+	http.Handle("/login/2fa", cors(rateLimit("/login/2fa", http.HandlerFunc(loginTwoFactorHandler))))
+	http.Handle("/login/oidc", cors(rateLimit("/login/oidc", http.HandlerFunc(oidcLoginHandler))))
+	http.Handle("/login/oidc/callback", cors(rateLimit("/login/oidc/callback", http.HandlerFunc(oidcCallbackHandler))))
+	http.Handle("/login/oidc/providers", cors(rateLimit("/login/oidc/providers", http.HandlerFunc(getOIDCProvidersHandler))))
+	http.Handle("/logout", cors(rateLimit("/logout", http.HandlerFunc(logoutHandler))))
+	http.Handle("/token/refresh", cors(rateLimit("/token/refresh", http.HandlerFunc(refreshTokenHandler))))
+	http.Handle("/register", cors(rateLimit("/register", http.HandlerFunc(registerHandler))))
+	http.Handle("/challenge", cors(rateLimit("/challenge", http.HandlerFunc(getChallengeHandler))))
+	http.Handle("/registration", cors(rateLimit("/registration", http.HandlerFunc(getRegistrationHandler))))
+	http.Handle("/invites", cors(rateLimitUser("/invites", http.HandlerFunc(handleLoginCheck(invitesHandler, map[string]string{"GET": scopeAccount, "POST": scopeAccount})))))
+	http.Handle("/invites/", cors(rateLimitUser("/invites/", http.HandlerFunc(handleLoginCheck(deleteInviteHandler, map[string]string{"DELETE": scopeAccount})))))
+	http.Handle("/verifyuser", cors(rateLimit("/verifyuser", http.HandlerFunc(verifyUserHandler))))
+	http.Handle("/resendverifyemail", cors(rateLimit("/resendverifyemail", http.HandlerFunc(resendVerifyEmailHandler))))
+	http.Handle("/forgotpassword", cors(rateLimit("/forgotpassword", http.HandlerFunc(forgotPasswordHandler))))
+	http.Handle("/resetpassword", cors(rateLimit("/resetpassword", http.HandlerFunc(resetPasswordHandler))))
+	http.Handle("/restoreaccount", cors(rateLimit("/restoreaccount", http.HandlerFunc(restoreAccountHandler))))
+	http.Handle("/csrftoken", cors(rateLimitUser("/csrftoken", http.HandlerFunc(handleLoginCheck(getCSRFTokenHandler, map[string]string{"GET": ""})))))
+	http.Handle("/deleteaccount", cors(rateLimitUser("/deleteaccount", http.HandlerFunc(handleLoginCheck(deleteAccountHandler, map[string]string{"POST": scopeAccount})))))
+	http.Handle("/changeemail", cors(rateLimitUser("/changeemail", http.HandlerFunc(handleLoginCheck(changeEmailHandler, map[string]string{"POST": scopeAccount})))))
+	http.Handle("/confirmemail", cors(rateLimit("/confirmemail", http.HandlerFunc(confirmEmailHandler))))
+	http.Handle("/revertemail", cors(rateLimit("/revertemail", http.HandlerFunc(revertEmailHandler))))
+	http.Handle("/changeusername", cors(rateLimitUser("/changeusername", http.HandlerFunc(handleLoginCheck(changeUsernameHandler, map[string]string{"POST": scopeAccount})))))
+	http.Handle("/changepassword", cors(rateLimitUser("/changepassword", http.HandlerFunc(handleLoginCheck(changePasswordHandler, map[string]string{"POST": scopeAccount})))))
+	http.Handle("/2fa/begin", cors(rateLimitUser("/2fa/begin", http.HandlerFunc(handleLoginCheck(beginTwoFactorHandler, map[string]string{"POST": scopeAccount})))))
+	http.Handle("/2fa/confirm", cors(rateLimitUser("/2fa/confirm", http.HandlerFunc(handleLoginCheck(confirmTwoFactorHandler, map[string]string{"POST": scopeAccount})))))
+	http.Handle("/2fa/disable", cors(rateLimitUser("/2fa/disable", http.HandlerFunc(handleLoginCheck(disableTwoFactorHandler, map[string]string{"POST": scopeAccount})))))
+	http.Handle("/apikeys", cors(rateLimitUser("/apikeys", http.HandlerFunc(handleLoginCheck(apiKeysHandler, map[string]string{"GET": scopeAccount, "POST": scopeAccount})))))
+	http.Handle("/apikeys/", cors(rateLimitUser("/apikeys/", http.HandlerFunc(handleLoginCheck(deleteAPIKeyHandler, map[string]string{"DELETE": scopeAccount})))))
+	http.Handle("/account/auditlog", cors(rateLimitUser("/account/auditlog", http.HandlerFunc(handleLoginCheck(getAuditLogHandler, map[string]string{"GET": scopeAccount})))))
+	http.Handle("/export", cors(rateLimitUser("/export", http.HandlerFunc(handleLoginCheck(exportHandler, map[string]string{"GET": scopeAccount})))))
+	http.Handle("/sessions", cors(rateLimitUser("/sessions", http.HandlerFunc(handleLoginCheck(getSessionsHandler, map[string]string{"GET": scopeAccount})))))
+	http.Handle("/sessions/", cors(rateLimitUser("/sessions/", http.HandlerFunc(handleLoginCheck(deleteSessionHandler, map[string]string{"DELETE": scopeAccount})))))
+	http.Handle("/sessions/revokeothers", cors(rateLimitUser("/sessions/revokeothers", http.HandlerFunc(handleLoginCheck(revokeOtherSessionsHandler, map[string]string{"POST": scopeAccount})))))
+	// OAuth endpoints.
+	http.Handle("/oauth/clients", cors(rateLimitUser("/oauth/clients", http.HandlerFunc(handleLoginCheck(oauthClientsHandler, map[string]string{"GET": scopeAccount, "POST": scopeAccount})))))
+	http.Handle("/oauth/clients/", cors(rateLimitUser("/oauth/clients/", http.HandlerFunc(handleLoginCheck(deleteOAuthClientHandler, map[string]string{"DELETE": scopeAccount})))))
+	http.Handle("/oauth/authorize", cors(rateLimitUser("/oauth/authorize", http.HandlerFunc(handleLoginCheck(authorizeHandler, map[string]string{"GET": scopeAccount, "POST": scopeAccount})))))
+	http.Handle("/oauth/token", cors(rateLimit("/oauth/token", http.HandlerFunc(oauthTokenHandler))))
+	http.Handle("/oauth/revoke", cors(rateLimit("/oauth/revoke", http.HandlerFunc(oauthRevokeHandler))))
+	http.Handle("/oauth/authorizations", cors(rateLimitUser("/oauth/authorizations", http.HandlerFunc(handleLoginCheck(getOAuthAuthorizationsHandler, map[string]string{"GET": scopeAccount})))))
+	http.Handle("/oauth/authorizations/", cors(rateLimitUser("/oauth/authorizations/", http.HandlerFunc(handleLoginCheck(revokeOAuthAuthorizationHandler, map[string]string{"DELETE": scopeAccount})))))
+	// Admin endpoints.
+	http.Handle("/admin/lockouts", cors(rateLimitUser("/admin/lockouts", http.HandlerFunc(handleRoleCheck(getLockoutsHandler, []string{"GET"}, roleAdmin)))))
+	http.Handle("/admin/lockouts/", cors(rateLimitUser("/admin/lockouts/", http.HandlerFunc(handleRoleCheck(deleteLockoutHandler, []string{"DELETE"}, roleAdmin)))))
+	http.Handle("/admin/users", cors(rateLimitUser("/admin/users", http.HandlerFunc(handleRoleCheck(getAdminUsersHandler, []string{"GET"}, roleAdmin)))))
+	http.Handle("/admin/users/", cors(rateLimitUser("/admin/users/", http.HandlerFunc(handleRoleCheck(adminUserHandler, []string{"GET", "POST"}, roleAdmin)))))
+	http.Handle("/admin/invites", cors(rateLimitUser("/admin/invites", http.HandlerFunc(handleRoleCheck(getAdminInvitesHandler, []string{"GET"}, roleAdmin)))))
+	http.Handle("/admin/invites/", cors(rateLimitUser("/admin/invites/", http.HandlerFunc(handleRoleCheck(deleteAdminInviteHandler, []string{"DELETE"}, roleAdmin)))))
 	// Data endpoints.
-	http.Handle("/todo", cors(http.HandlerFunc(handleLoginCheck(createTodoHandler, []string{"POST"}))))
-	http.Handle("/todos", cors(http.HandlerFunc(handleLoginCheck(getTodosHandler, []string{"GET"}))))
-	http.Handle("/todo/", cors(http.HandlerFunc(handleLoginCheck(todoHandler, []string{"DELETE", "PATCH", "GET"}))))
+	http.Handle("/todo", cors(rateLimitUser("/todo", http.HandlerFunc(handleLoginCheck(createTodoHandler, map[string]string{"POST": scopeTodosWrite})))))
+	http.Handle("/todos", cors(rateLimitUser("/todos", http.HandlerFunc(handleLoginCheck(getTodosHandler, map[string]string{"GET": scopeTodosRead})))))
+	http.Handle("/todo/", cors(rateLimitUser("/todo/", http.HandlerFunc(handleLoginCheck(todoHandler, map[string]string{"GET": scopeTodosRead, "PATCH": scopeTodosWrite, "DELETE": scopeTodosWrite})))))
 
 	// Start listening on specified port.
 	infoLog.Printf("Listening on port %d.\n", config.Port)
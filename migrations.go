@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// applySchema creates a collection with the given schema, or updates the schema of an existing one.
+func applySchema(ctx context.Context, name string, schema interface{}) error {
+	validator := bson.M{"$jsonSchema": schema}
+	err := database.CreateCollection(ctx, name, &options.CreateCollectionOptions{Validator: validator})
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && commandErr.Name == "NamespaceExists" {
+		return database.RunCommand(ctx, bson.D{{Key: "collMod", Value: name}, {Key: "validator", Value: validator}}).Err()
+	}
+	return err
+}
+
+// Migrations only match documents which haven't been migrated yet, so if one is interrupted, running it again
+// carries on with the rest.
+
+const migrationBatchSize = 1000
+
+// migrateHashedTokens replaces tokens stored in plaintext by older versions with their digests. Tokens are
+// updated in batches, so progress is saved as it goes.
+func migrateHashedTokens(ctx context.Context) (int, error) {
+	cursor, err := database.Collection("tokens").Find(
+		ctx, bson.M{"token": bson.M{"$not": primitive.Regex{Pattern: "^[0-9a-f]{64}$"}}},
+		options.Find().SetProjection(bson.M{"token": 1}).SetBatchSize(migrationBatchSize),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	migrated := 0
+	var updates []mongo.WriteModel
+	flush := func() error {
+		if len(updates) == 0 {
+			return nil
+		}
+		// Each update checks the token is still in plaintext, in case it was already migrated.
+		result, err := database.Collection("tokens").BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+		migrated += int(result.ModifiedCount)
+		updates = updates[:0]
+		return nil
+	}
+	for cursor.Next(ctx) {
+		var document TokenDocument
+		err = cursor.Decode(&document)
+		if err != nil {
+			return migrated, err
+		}
+		updates = append(updates, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": document.ID, "token": document.Token}).
+			SetUpdate(bson.M{"$set": bson.M{"token": hashToken(document.Token)}}))
+		if len(updates) == migrationBatchSize {
+			if err = flush(); err != nil {
+				return migrated, err
+			}
+		}
+	}
+	if cursor.Err() != nil {
+		return migrated, cursor.Err()
+	}
+	return migrated, flush()
+}
+
+// migrateTokenExpiry sets expiresAt on tokens issued by older versions, so the TTL index can remove them.
+func migrateTokenExpiry(ctx context.Context) (int, error) {
+	lifetime := config.Session.Lifetime.Duration / time.Millisecond
+	result, err := database.Collection("tokens").UpdateMany(
+		ctx, bson.M{"expiresAt": bson.M{"$exists": false}},
+		bson.A{bson.M{"$set": bson.M{"expiresAt": bson.M{"$add": bson.A{"$issuedOn", int64(lifetime)}}}}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return int(result.ModifiedCount), nil
+}
+
+func createIndexes(ctx context.Context) error {
+	_, err := database.Collection("tokens").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"token": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"username": 1}},
+		{Keys: bson.M{"family": 1}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("login_challenges").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"challenge": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("api_keys").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"key": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"username": 1}},
+		{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("oauth_clients").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"clientId": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"owner": 1}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("oauth_codes").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"code": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("oidc_states").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"state": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("login_attempts").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"key": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"lockedUntil": 1}},
+		{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("rate_limits").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("reserved_usernames").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"username": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"owner": 1}},
+		{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("audit_events").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("invites").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"code": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "createdBy", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.M{"purgeAfter": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("admin_promotions").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"username": 1}, Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("used_challenges").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"challenge": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.Collection("users").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "oidcIdentities.provider", Value: 1}, {Key: "oidcIdentities.subject", Value: 1}}},
+		{Keys: bson.M{"deleteAfter": 1}, Options: options.Index().SetSparse(true)},
+	})
+	if err != nil {
+		return err
+	}
+	return createUniqueUserIndexes(ctx)
+}
+
+// createUniqueUserIndexes makes usernames and emails unique. Older versions only checked before inserting, so
+// if users already share a username or email, they are logged and the index is skipped until they are resolved.
+func createUniqueUserIndexes(ctx context.Context) error {
+	for _, field := range []string{"username", "email"} {
+		cursor, err := database.Collection("users").Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$group", Value: bson.M{"_id": "$" + field, "ids": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}}},
+			{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		})
+		if err != nil {
+			return err
+		}
+		var duplicates []struct {
+			Value string               `bson:"_id"`
+			IDs   []primitive.ObjectID `bson:"ids"`
+		}
+		err = cursor.All(ctx, &duplicates)
+		if err != nil {
+			return err
+		}
+		for _, duplicate := range duplicates {
+			log.Printf("Users %v share the %s %s.\n", duplicate.IDs, field, duplicate.Value)
+		}
+		if len(duplicates) > 0 {
+			log.Printf("Not making users.%s unique until %d duplicates are resolved.\n", field, len(duplicates))
+			continue
+		}
+		_, err = database.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.M{field: 1}, Options: options.Index().SetUnique(true).SetName(field + "_unique"),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to make users.%s unique: %w", field, err)
+		}
+	}
+	return nil
+}
+
+// duplicateUserField returns the field of a user which err says is already used by another user, or an empty
+// string if err isn't a duplicate key error from createUniqueUserIndexes.
+func duplicateUserField(err error) string {
+	if !mongo.IsDuplicateKeyError(err) {
+		return ""
+	} else if strings.Contains(err.Error(), "email_unique") {
+		return "email"
+	} else if strings.Contains(err.Error(), "username_unique") {
+		return "username"
+	}
+	return ""
+}
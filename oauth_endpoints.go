@@ -0,0 +1,535 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OAuth 2.0 authorization code flow (RFC 6749) with mandatory PKCE (RFC 7636) for third-party clients.
+// Tokens issued to clients are stored in the tokens collection with the client ID and granted scopes.
+
+const oauthCodeLifetime = time.Minute * 10
+
+// Third-party clients can never be granted the account scope.
+var oauthScopes = []string{scopeTodosRead, scopeTodosWrite}
+
+func parseOAuthScopes(scope string) ([]string, bool) {
+	scopes := []string{}
+	for _, s := range strings.Fields(scope) {
+		if !hasScope(oauthScopes, s) {
+			return nil, false
+		} else if !hasScope(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes, len(scopes) > 0
+}
+
+// validRedirectURI only allows HTTPS redirects, except to loopback addresses or custom schemes for native apps.
+func validRedirectURI(uri string) bool {
+	parsed, err := url.Parse(uri)
+	if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+		return false
+	} else if parsed.Scheme == "http" {
+		hostname := parsed.Hostname()
+		return hostname == "localhost" || hostname == "127.0.0.1" || hostname == "::1"
+	}
+	return parsed.Scheme != "javascript" && parsed.Scheme != "data" && (parsed.Scheme != "https" || parsed.Host != "")
+}
+
+type OAuthClientData struct {
+	ClientID     string    `json:"clientId"`
+	ClientSecret string    `json:"clientSecret,omitempty"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirectUris"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+func oauthClientsHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	if r.Method == "POST" {
+		createOAuthClientHandler(w, r, username)
+	} else {
+		getOAuthClientsHandler(w, r, username)
+	}
+}
+
+func getOAuthClientsHandler(w http.ResponseWriter, r *http.Request, username string) {
+	cursor, err := database.Collection("oauth_clients").Find(
+		mongoCtx, bson.M{"owner": username}, options.Find().SetSort(bson.M{"createdAt": -1}),
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	var documents []OAuthClientDocument
+	err = cursor.All(mongoCtx, &documents)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	clients := make([]OAuthClientData, 0, len(documents))
+	for _, document := range documents {
+		clients = append(clients, OAuthClientData{
+			ClientID:     document.ClientID,
+			Name:         document.Name,
+			RedirectURIs: document.RedirectURIs,
+			Confidential: document.Secret != "",
+			CreatedAt:    document.CreatedAt,
+		})
+	}
+	json.NewEncoder(w).Encode(struct {
+		Clients []OAuthClientData `json:"clients"`
+	}{Clients: clients})
+}
+
+type CreateOAuthClientData struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirectUris"`
+	Confidential bool     `json:"confidential"`
+}
+
+func createOAuthClientHandler(w http.ResponseWriter, r *http.Request, username string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var clientData CreateOAuthClientData
+	err = json.Unmarshal(body, &clientData)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	} else if clientData.Name == "" || len(clientData.Name) > 64 {
+		http.Error(w, `{"error":"Client name must be 1-64 characters long!"}`, http.StatusBadRequest)
+		return
+	} else if len(clientData.RedirectURIs) == 0 || len(clientData.RedirectURIs) > 10 {
+		http.Error(w, `{"error":"Clients must have 1-10 redirect URIs!"}`, http.StatusBadRequest)
+		return
+	}
+	for _, uri := range clientData.RedirectURIs {
+		if !validRedirectURI(uri) {
+			http.Error(w, `{"error":"Invalid redirect URI provided!"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	clientIDBytes, err := generateToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	nowTime := time.Now().UTC()
+	client := OAuthClientData{
+		ClientID:     hex.EncodeToString(clientIDBytes[:16]),
+		Name:         clientData.Name,
+		RedirectURIs: clientData.RedirectURIs,
+		Confidential: clientData.Confidential,
+		CreatedAt:    nowTime,
+	}
+	document := bson.M{
+		"clientId":     client.ClientID,
+		"name":         client.Name,
+		"redirectUris": client.RedirectURIs,
+		"owner":        username,
+		"createdAt":    nowTime,
+	}
+	if clientData.Confidential {
+		secretBytes, err := generateToken()
+		if err != nil {
+			log.Println(err)
+			http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+			return
+		}
+		client.ClientSecret = base64.RawURLEncoding.EncodeToString(secretBytes)
+		document["secret"] = hashToken(client.ClientSecret)
+	}
+	_, err = database.Collection("oauth_clients").InsertOne(mongoCtx, document)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(client)
+}
+
+func deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	pathSegments := strings.Split(r.URL.Path, "/")[3:]
+	if len(pathSegments) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	clientID := pathSegments[0]
+	result, err := database.Collection("oauth_clients").DeleteOne(
+		mongoCtx, bson.M{"clientId": clientID, "owner": username},
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if result.DeletedCount == 0 {
+		http.Error(w, `{"error":"Client not found!"}`, http.StatusNotFound)
+		return
+	}
+	// Revoke everything issued to the client, for every user who authorised it.
+	_, err = database.Collection("oauth_codes").DeleteMany(mongoCtx, bson.M{"clientId": clientID})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	_, err = database.Collection("tokens").DeleteMany(mongoCtx, bson.M{"clientId": clientID})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(`{"success":true}`))
+}
+
+type authorizeRequest struct {
+	Client              OAuthClientDocument
+	RedirectURI         string
+	RedirectURIProvided bool // Whether redirect_uri was given, so the token request has to include it.
+	Scopes              []string
+	State               string
+	CodeChallenge       string
+}
+
+// parseAuthorizeRequest validates the query parameters of an authorization request, returning an error
+// message for the user if they are invalid.
+func parseAuthorizeRequest(query url.Values) (*authorizeRequest, string, error) {
+	var request authorizeRequest
+	err := database.Collection("oauth_clients").FindOne(
+		mongoCtx, bson.M{"clientId": query.Get("client_id")},
+	).Decode(&request.Client)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, "Invalid client_id provided!", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+	request.RedirectURI = query.Get("redirect_uri")
+	request.RedirectURIProvided = request.RedirectURI != ""
+	if request.RedirectURI == "" && len(request.Client.RedirectURIs) == 1 {
+		request.RedirectURI = request.Client.RedirectURIs[0]
+	}
+	registered := false
+	for _, uri := range request.Client.RedirectURIs {
+		if uri == request.RedirectURI {
+			registered = true
+		}
+	}
+	if !registered {
+		return nil, "Invalid redirect_uri provided!", nil
+	}
+	var ok bool
+	request.Scopes, ok = parseOAuthScopes(query.Get("scope"))
+	request.State = query.Get("state")
+	request.CodeChallenge = query.Get("code_challenge")
+	if query.Get("response_type") != "code" {
+		return nil, "Unsupported response_type provided!", nil
+	} else if !ok {
+		return nil, "Invalid scope provided!", nil
+	} else if query.Get("code_challenge_method") != "S256" || len(request.CodeChallenge) != 43 {
+		return nil, "PKCE with code_challenge_method S256 is required!", nil
+	}
+	return &request, "", nil
+}
+
+type AuthorizeData struct {
+	Approve bool `json:"approve"`
+}
+
+// authorizeHandler is called by the consent page of the Cerulean front-end with the query string of the
+// authorization request. GET returns details to show the user, and POST returns the URI to redirect to.
+func authorizeHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	request, message, err := parseAuthorizeRequest(r.URL.Query())
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if request == nil {
+		http.Error(w, `{"error":"`+message+`"}`, http.StatusBadRequest)
+		return
+	}
+	if r.Method == "GET" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"clientId":    request.Client.ClientID,
+			"name":        request.Client.Name,
+			"redirectUri": request.RedirectURI,
+			"scopes":      request.Scopes,
+		})
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var authorizeData AuthorizeData
+	err = json.Unmarshal(body, &authorizeData)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	redirectURI, _ := url.Parse(request.RedirectURI)
+	redirectQuery := redirectURI.Query()
+	if request.State != "" {
+		redirectQuery.Set("state", request.State)
+	}
+	if !authorizeData.Approve {
+		redirectQuery.Set("error", "access_denied")
+		redirectURI.RawQuery = redirectQuery.Encode()
+		json.NewEncoder(w).Encode(map[string]string{"redirectUri": redirectURI.String()})
+		return
+	}
+	bytes, err := generateToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	code := base64.RawURLEncoding.EncodeToString(bytes)
+	_, err = database.Collection("oauth_codes").InsertOne(mongoCtx, bson.M{
+		"code":                hashToken(code),
+		"clientId":            request.Client.ClientID,
+		"username":            username,
+		"redirectUri":         request.RedirectURI,
+		"redirectUriProvided": request.RedirectURIProvided,
+		"scopes":              request.Scopes,
+		"codeChallenge":       request.CodeChallenge,
+		"expiresAt":           time.Now().UTC().Add(oauthCodeLifetime),
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	redirectQuery.Set("code", code)
+	redirectURI.RawQuery = redirectQuery.Encode()
+	json.NewEncoder(w).Encode(map[string]string{"redirectUri": redirectURI.String()})
+}
+
+func oauthError(w http.ResponseWriter, code string, description string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+// authenticateOAuthClient checks the client ID and secret sent with a request to the token or revoke
+// endpoints, either in the body or with HTTP Basic authentication.
+func authenticateOAuthClient(r *http.Request) (*OAuthClientDocument, error) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	var client OAuthClientDocument
+	err := database.Collection("oauth_clients").FindOne(mongoCtx, bson.M{"clientId": clientID}).Decode(&client)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if client.Secret != "" && !hmac.Equal([]byte(hashToken(clientSecret)), []byte(client.Secret)) {
+		return nil, nil
+	}
+	return &client, nil
+}
+
+func oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	} else if err := r.ParseForm(); err != nil {
+		oauthError(w, "invalid_request", "Invalid body sent!", http.StatusBadRequest)
+		return
+	} else if r.PostForm.Get("grant_type") != "authorization_code" {
+		oauthError(w, "unsupported_grant_type", "Only authorization_code is supported!", http.StatusBadRequest)
+		return
+	}
+	client, err := authenticateOAuthClient(r)
+	if err != nil {
+		log.Println(err)
+		oauthError(w, "server_error", "Internal Server Error!", http.StatusInternalServerError)
+		return
+	} else if client == nil {
+		oauthError(w, "invalid_client", "Invalid client credentials!", http.StatusUnauthorized)
+		return
+	}
+	// Codes are deleted when redeemed, so they can only be used once.
+	var code OAuthCodeDocument
+	err = database.Collection("oauth_codes").FindOneAndDelete(mongoCtx, bson.M{
+		"code":      hashToken(r.PostForm.Get("code")),
+		"clientId":  client.ClientID,
+		"expiresAt": bson.M{"$gt": time.Now().UTC()},
+	}).Decode(&code)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		oauthError(w, "invalid_grant", "Invalid or expired code!", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println(err)
+		oauthError(w, "server_error", "Internal Server Error!", http.StatusInternalServerError)
+		return
+	} else if code.RedirectURIProvided && r.PostForm.Get("redirect_uri") != code.RedirectURI {
+		// RFC 6749 section 4.1.3 only requires redirect_uri if it was included in the authorization request.
+		oauthError(w, "invalid_grant", "redirect_uri does not match!", http.StatusBadRequest)
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !hmac.Equal([]byte(base64.RawURLEncoding.EncodeToString(challenge[:])), []byte(code.CodeChallenge)) {
+		oauthError(w, "invalid_grant", "Invalid code_verifier!", http.StatusBadRequest)
+		return
+	}
+	bytes, err := generateToken()
+	if err != nil {
+		log.Println(err)
+		oauthError(w, "server_error", "Internal Server Error!", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(bytes)
+	nowTime := time.Now().UTC()
+	expiresAt := sessionExpiresAt(nowTime, nowTime)
+	_, err = database.Collection("tokens").InsertOne(mongoCtx, bson.M{
+		"token":      hashToken(token),
+		"username":   code.Username,
+		"clientId":   client.ClientID,
+		"scopes":     code.Scopes,
+		"issuedOn":   nowTime,
+		"expiresAt":  expiresAt,
+		"lastUsedAt": nowTime,
+		"userAgent":  r.UserAgent(),
+		"ip":         clientIP(r),
+	})
+	if err != nil {
+		log.Println(err)
+		oauthError(w, "server_error", "Internal Server Error!", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(expiresAt.Sub(nowTime).Seconds()),
+		"scope":        strings.Join(code.Scopes, " "),
+	})
+}
+
+// oauthRevokeHandler implements RFC 7009, which always succeeds even if the token is invalid.
+func oauthRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	} else if err := r.ParseForm(); err != nil {
+		oauthError(w, "invalid_request", "Invalid body sent!", http.StatusBadRequest)
+		return
+	}
+	client, err := authenticateOAuthClient(r)
+	if err != nil {
+		log.Println(err)
+		oauthError(w, "server_error", "Internal Server Error!", http.StatusInternalServerError)
+		return
+	} else if client == nil {
+		oauthError(w, "invalid_client", "Invalid client credentials!", http.StatusUnauthorized)
+		return
+	}
+	var document TokenDocument
+	err = database.Collection("tokens").FindOneAndDelete(mongoCtx, bson.M{
+		"token": hashToken(r.PostForm.Get("token")), "clientId": client.ClientID,
+	}).Decode(&document)
+	if err == nil {
+		recordAuditEvent(r, document.Username, auditTokenRevoke, auditSuccess, "OAuth token revoked by client "+client.ClientID)
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		log.Println(err)
+		oauthError(w, "server_error", "Internal Server Error!", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(`{}`))
+}
+
+type OAuthAuthorizationData struct {
+	ClientID     string    `json:"clientId" bson:"_id"`
+	Name         string    `json:"name" bson:"name"`
+	Scopes       []string  `json:"scopes" bson:"scopes"`
+	AuthorizedAt time.Time `json:"authorizedAt" bson:"authorizedAt"`
+	LastUsedAt   time.Time `json:"lastUsedAt" bson:"lastUsedAt"`
+}
+
+func getOAuthAuthorizationsHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	cursor, err := database.Collection("tokens").Aggregate(mongoCtx, bson.A{
+		bson.M{"$match": bson.M{"username": username, "clientId": bson.M{"$exists": true}}},
+		bson.M{"$group": bson.M{
+			"_id":          "$clientId",
+			"scopes":       bson.M{"$push": "$scopes"},
+			"authorizedAt": bson.M{"$min": "$issuedOn"},
+			"lastUsedAt":   bson.M{"$max": "$lastUsedAt"},
+		}},
+		bson.M{"$lookup": bson.M{
+			"from": "oauth_clients", "localField": "_id", "foreignField": "clientId", "as": "client",
+		}},
+		bson.M{"$project": bson.M{
+			"name":         bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$client.name", 0}}, ""}},
+			"scopes":       bson.M{"$reduce": bson.M{"input": "$scopes", "initialValue": bson.A{}, "in": bson.M{"$setUnion": bson.A{"$$value", "$$this"}}}},
+			"authorizedAt": 1,
+			"lastUsedAt":   1,
+		}},
+		bson.M{"$sort": bson.M{"authorizedAt": -1}},
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	authorizations := []OAuthAuthorizationData{}
+	err = cursor.All(mongoCtx, &authorizations)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Authorizations []OAuthAuthorizationData `json:"authorizations"`
+	}{Authorizations: authorizations})
+}
+
+func revokeOAuthAuthorizationHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	pathSegments := strings.Split(r.URL.Path, "/")[3:]
+	if len(pathSegments) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	filter := bson.M{"username": username, "clientId": pathSegments[0]}
+	result, err := database.Collection("tokens").DeleteMany(mongoCtx, filter)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	_, err = database.Collection("oauth_codes").DeleteMany(mongoCtx, filter)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if result.DeletedCount == 0 {
+		http.Error(w, `{"error":"Authorization not found!"}`, http.StatusNotFound)
+		return
+	}
+	recordAuditEvent(r, username, auditTokenRevoke, auditSuccess, "OAuth client "+pathSegments[0])
+	w.Write([]byte(`{"success":true}`))
+}
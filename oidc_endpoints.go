@@ -0,0 +1,667 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Login with external OpenID Connect providers, using the authorization code flow with PKCE. The provider
+// redirects back to the front-end at /oidc/callback, which passes the code and state to POST /login/oidc/callback.
+
+const oidcStateLifetime = time.Minute * 10
+
+type OIDCProviderConfig struct {
+	Name         string   `json:"name"`
+	DisplayName  string   `json:"displayName"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+}
+
+var oidcNameRegex = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+func setOIDCDefaults(providers []OIDCProviderConfig) error {
+	for i := range providers {
+		provider := &providers[i]
+		if !oidcNameRegex.MatchString(provider.Name) {
+			return fmt.Errorf("invalid oidc provider name: %q", provider.Name)
+		} else if provider.Issuer == "" || provider.ClientID == "" {
+			return fmt.Errorf("oidc provider %s is missing an issuer or client ID", provider.Name)
+		} else if findOIDCProvider(providers[:i], provider.Name) != nil {
+			return fmt.Errorf("duplicate oidc provider name: %s", provider.Name)
+		}
+		provider.Issuer = strings.TrimSuffix(provider.Issuer, "/")
+		if provider.DisplayName == "" {
+			provider.DisplayName = provider.Name
+		}
+		if len(provider.Scopes) == 0 {
+			provider.Scopes = []string{"openid", "email", "profile"}
+		} else if !hasScope(provider.Scopes, "openid") {
+			provider.Scopes = append([]string{"openid"}, provider.Scopes...)
+		}
+	}
+	return nil
+}
+
+func findOIDCProvider(providers []OIDCProviderConfig, name string) *OIDCProviderConfig {
+	for i := range providers {
+		if providers[i].Name == name {
+			return &providers[i]
+		}
+	}
+	return nil
+}
+
+func oidcRedirectURI() string {
+	return config.FrontendUrl + "/oidc/callback"
+}
+
+var oidcHTTPClient = &http.Client{Timeout: time.Second * 10}
+
+func oidcGetJSON(uri string, accessToken string, v interface{}) error {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	res, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned status %d", uri, res.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// oidcProviderState caches the discovery document and signing keys of a provider.
+type oidcProviderState struct {
+	discovery     *oidcDiscovery
+	keys          []oidcJWK
+	keysFetchedAt time.Time
+}
+
+// The mutex is never held during requests to providers, so a slow provider can't hold up logins with the others.
+var oidcCache = map[string]*oidcProviderState{}
+var oidcCacheMutex sync.Mutex
+
+func oidcProviderMetadata(provider *OIDCProviderConfig) (*oidcDiscovery, error) {
+	oidcCacheMutex.Lock()
+	state, ok := oidcCache[provider.Name]
+	oidcCacheMutex.Unlock()
+	if ok {
+		return state.discovery, nil
+	}
+	var discovery oidcDiscovery
+	err := oidcGetJSON(provider.Issuer+"/.well-known/openid-configuration", "", &discovery)
+	if err != nil {
+		return nil, err
+	} else if strings.TrimSuffix(discovery.Issuer, "/") != provider.Issuer {
+		return nil, fmt.Errorf("oidc provider %s has issuer %s in its discovery document", provider.Name, discovery.Issuer)
+	} else if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc provider %s has an incomplete discovery document", provider.Name)
+	}
+	// Logins which started at the same time may have fetched it too, in which case the first one is kept.
+	oidcCacheMutex.Lock()
+	defer oidcCacheMutex.Unlock()
+	if state, ok := oidcCache[provider.Name]; ok {
+		return state.discovery, nil
+	}
+	oidcCache[provider.Name] = &oidcProviderState{discovery: &discovery}
+	return &discovery, nil
+}
+
+func findOIDCSigningKey(keys []oidcJWK, kid string, alg string) *oidcJWK {
+	for i, key := range keys {
+		if (kid == "" || key.Kid == kid) && (key.Use == "" || key.Use == "sig") && (key.Alg == "" || key.Alg == alg) {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+// oidcSigningKey finds the key an ID token was signed with, refetching the JWKS if the provider rotated its keys.
+func oidcSigningKey(provider *OIDCProviderConfig, kid string, alg string) (crypto.PublicKey, error) {
+	oidcCacheMutex.Lock()
+	state := oidcCache[provider.Name]
+	if state == nil {
+		oidcCacheMutex.Unlock()
+		return nil, errors.New("oidc provider metadata has not been fetched")
+	} else if key := findOIDCSigningKey(state.keys, kid, alg); key != nil {
+		oidcCacheMutex.Unlock()
+		return parseOIDCKey(*key, alg)
+	} else if time.Since(state.keysFetchedAt) < time.Minute {
+		// Don't let clients make us hammer the provider with invalid key IDs.
+		oidcCacheMutex.Unlock()
+		return nil, fmt.Errorf("no key found for kid %q", kid)
+	}
+	// Only one login refetches the keys each minute, the others fail until it's done.
+	state.keysFetchedAt = time.Now()
+	jwksURI := state.discovery.JWKSURI
+	oidcCacheMutex.Unlock()
+	var jwks struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	err := oidcGetJSON(jwksURI, "", &jwks)
+	if err != nil {
+		return nil, err
+	}
+	oidcCacheMutex.Lock()
+	state.keys = jwks.Keys
+	oidcCacheMutex.Unlock()
+	if key := findOIDCSigningKey(jwks.Keys, kid, alg); key != nil {
+		return parseOIDCKey(*key, alg)
+	}
+	return nil, fmt.Errorf("no key found for kid %q", kid)
+}
+
+func parseOIDCKey(key oidcJWK, alg string) (crypto.PublicKey, error) {
+	decode := func(value string) *big.Int {
+		bytes, _ := base64.RawURLEncoding.DecodeString(value)
+		return new(big.Int).SetBytes(bytes)
+	}
+	if alg == "RS256" && key.Kty == "RSA" {
+		n, e := decode(key.N), decode(key.E)
+		if n.Sign() == 0 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	} else if alg == "ES256" && key.Kty == "EC" && key.Crv == "P-256" {
+		x, y := decode(key.X), decode(key.Y)
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s for alg %s", key.Kty, alg)
+}
+
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = []string{single}
+		return nil
+	}
+	var multiple []string
+	err := json.Unmarshal(data, &multiple)
+	*a = multiple
+	return err
+}
+
+type IDTokenClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          oidcAudience `json:"aud"`
+	AuthorizedParty   string       `json:"azp"`
+	ExpiresAt         int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	EmailVerified     interface{}  `json:"email_verified"` // Some providers send this as a string.
+	PreferredUsername string       `json:"preferred_username"`
+}
+
+func (c *IDTokenClaims) emailVerified() bool {
+	return c.EmailVerified == true || c.EmailVerified == "true"
+}
+
+// verifyIDToken checks the signature and claims of an ID token as described in OpenID Connect Core 3.1.3.7.
+func verifyIDToken(provider *OIDCProviderConfig, idToken string, nonce string) (*IDTokenClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(headerBytes, &header)
+	if err != nil {
+		return nil, err
+	}
+	key, err := oidcSigningKey(provider, header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 || !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			err = errors.New("invalid signature")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims IDTokenClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, err
+	}
+	nowTime := time.Now().UTC().Unix()
+	if strings.TrimSuffix(claims.Issuer, "/") != provider.Issuer {
+		return nil, errors.New("ID token has the wrong issuer")
+	} else if !hasScope(claims.Audience, provider.ClientID) {
+		return nil, errors.New("ID token has the wrong audience")
+	} else if len(claims.Audience) > 1 && claims.AuthorizedParty != provider.ClientID {
+		return nil, errors.New("ID token has the wrong authorized party")
+	} else if claims.ExpiresAt <= nowTime-60 || claims.IssuedAt > nowTime+60 {
+		return nil, errors.New("ID token has expired")
+	} else if claims.Subject == "" || claims.Nonce != nonce {
+		return nil, errors.New("ID token has the wrong nonce")
+	}
+	return &claims, nil
+}
+
+type OIDCProviderData struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+func getOIDCProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		http.Error(w, `{"error":"Allowed methods: GET"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	providers := make([]OIDCProviderData, 0, len(config.OIDC))
+	for _, provider := range config.OIDC {
+		providers = append(providers, OIDCProviderData{Name: provider.Name, DisplayName: provider.DisplayName})
+	}
+	json.NewEncoder(w).Encode(struct {
+		Providers []OIDCProviderData `json:"providers"`
+	}{Providers: providers})
+}
+
+type OIDCLoginData struct {
+	Provider string `json:"provider"`
+}
+
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var loginData OIDCLoginData
+	err = json.Unmarshal(body, &loginData)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	provider := findOIDCProvider(config.OIDC, loginData.Provider)
+	if provider == nil {
+		http.Error(w, `{"error":"Unknown login provider!"}`, http.StatusNotFound)
+		return
+	}
+	discovery, err := oidcProviderMetadata(provider)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Login provider is unavailable!"}`, http.StatusBadGateway)
+		return
+	}
+	var secrets [3]string
+	for i := range secrets {
+		bytes, err := generateToken()
+		if err != nil {
+			log.Println(err)
+			http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+			return
+		}
+		secrets[i] = base64.RawURLEncoding.EncodeToString(bytes)
+	}
+	state, nonce, codeVerifier := secrets[0], secrets[1], secrets[2]
+	_, err = database.Collection("oidc_states").InsertOne(mongoCtx, bson.M{
+		"state":        hashToken(state),
+		"provider":     provider.Name,
+		"nonce":        nonce,
+		"codeVerifier": codeVerifier,
+		"expiresAt":    time.Now().UTC().Add(oidcStateLifetime),
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.ClientID},
+		"redirect_uri":          {oidcRedirectURI()},
+		"scope":                 {strings.Join(provider.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"redirectUri": discovery.AuthorizationEndpoint + separator + query.Encode(),
+	})
+}
+
+// exchangeOIDCCode redeems an authorization code at the provider's token endpoint.
+func exchangeOIDCCode(provider *OIDCProviderConfig, discovery *oidcDiscovery, code string, codeVerifier string) (string, string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURI()},
+		"code_verifier": {codeVerifier},
+	}
+	if provider.ClientSecret == "" {
+		form.Set("client_id", provider.ClientID)
+	}
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if provider.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(provider.ClientID), url.QueryEscape(provider.ClientSecret))
+	}
+	res, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&tokenResponse)
+	if err != nil {
+		return "", "", err
+	} else if res.StatusCode != http.StatusOK || tokenResponse.IDToken == "" {
+		return "", "", fmt.Errorf("token endpoint of %s returned status %d: %s", provider.Name, res.StatusCode, tokenResponse.Error)
+	}
+	return tokenResponse.IDToken, tokenResponse.AccessToken, nil
+}
+
+// findOIDCUser finds the user linked to an external identity, linking or creating an account if necessary.
+func findOIDCUser(r *http.Request, provider *OIDCProviderConfig, claims *IDTokenClaims) (*UserDocument, string, error) {
+	var user UserDocument
+	identity := bson.D{{Key: "provider", Value: provider.Name}, {Key: "subject", Value: claims.Subject}}
+	err := database.Collection("users").FindOne(mongoCtx, bson.M{
+		"oidcIdentities": bson.M{"$elemMatch": bson.M{"provider": provider.Name, "subject": claims.Subject}},
+	}).Decode(&user)
+	if err == nil {
+		return &user, "", nil
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, "", err
+	} else if claims.Email == "" || !claims.emailVerified() {
+		return nil, "Your login provider did not share a verified email address!", nil
+	}
+	// Link to an existing account with the same email, as long as its owner proved they own the email too.
+	err = database.Collection("users").FindOne(mongoCtx, bson.M{"email": claims.Email}).Decode(&user)
+	if err == nil {
+		if user.Verified != "" {
+			return nil, "An unverified account with this email already exists! Verify it before logging in with this provider.", nil
+		}
+		_, err = database.Collection("users").UpdateOne(
+			mongoCtx, bson.M{"username": user.Username}, bson.M{"$addToSet": bson.M{"oidcIdentities": identity}},
+		)
+		if err != nil {
+			return nil, "", err
+		}
+		return &user, "", nil
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, "", err
+	}
+	return createOIDCUser(r, provider, claims, identity)
+}
+
+var oidcUsernameRegex = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func createOIDCUser(
+	r *http.Request, provider *OIDCProviderConfig, claims *IDTokenClaims, identity bson.D,
+) (*UserDocument, string, error) {
+	if !emailRegex.MatchString(claims.Email) || len(claims.Email) > 254 {
+		return nil, "Your login provider shared an email address which is not supported!", nil
+	}
+	if message := registrationError(claims.Email); message != "" {
+		return nil, message, nil
+	} else if config.Registration.Mode == registrationInvite {
+		return nil, "An invite is required to register! Register with your invite before logging in with this provider.", nil
+	}
+	base := claims.PreferredUsername
+	if at := strings.Index(base, "@"); at >= 0 {
+		base = base[:at]
+	}
+	if base == "" {
+		base = claims.Email[:strings.Index(claims.Email, "@")]
+	}
+	base = oidcUsernameRegex.ReplaceAllString(base, "_")
+	if len(base) > 11 {
+		base = base[:11]
+	}
+	for len(base) < 4 {
+		base += "_"
+	}
+	// The user has no password, so they can only log in with the provider until they reset it.
+	passwordBytes, err := generateToken()
+	if err != nil {
+		return nil, "", err
+	}
+	passwordHash, err := hashPassword(hex.EncodeToString(passwordBytes))
+	if err != nil {
+		return nil, "", err
+	}
+	nowTime := time.Now().UTC()
+	user := UserDocument{
+		Email:      claims.Email,
+		Password:   passwordHash,
+		LastEdited: nowTime,
+		Todos:      []TodoDocument{},
+	}
+	for attempt := 0; user.Username == ""; attempt++ {
+		candidate := base
+		if attempt >= 5 {
+			return nil, "", errors.New("could not generate a unique username")
+		} else if attempt > 0 {
+			suffix, err := generateToken()
+			if err != nil {
+				return nil, "", err
+			}
+			candidate = base + "_" + hex.EncodeToString(suffix[:2])
+		}
+		err = database.Collection("users").FindOne(mongoCtx, bson.M{"username": candidate}).Err()
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			reserved, err := usernameReserved(mongoCtx, candidate, "")
+			if err != nil {
+				return nil, "", err
+			} else if !reserved {
+				user.Username = candidate
+			}
+		} else if err != nil {
+			return nil, "", err
+		}
+	}
+	_, err = database.Collection("users").InsertOne(mongoCtx, bson.M{
+		"username":       user.Username,
+		"password":       user.Password,
+		"email":          user.Email,
+		"verified":       "",
+		"oidcIdentities": bson.A{identity},
+		"lastEdited":     user.LastEdited,
+		"todos":          bson.A{},
+	})
+	if field := duplicateUserField(err); field == "email" {
+		return nil, "A user with this email already exists!", nil
+	} else if field == "username" {
+		return nil, "Someone registered the same username at the same time! Please try again.", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+	recordAuditEvent(r, user.Username, auditRegister, auditSuccess, "oidc:"+provider.Name)
+	return &user, "", nil
+}
+
+type OIDCCallbackData struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var callbackData OIDCCallbackData
+	err = json.Unmarshal(body, &callbackData)
+	if err != nil || callbackData.Code == "" || callbackData.State == "" {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	// Each state can only be used once.
+	var state OIDCStateDocument
+	err = database.Collection("oidc_states").FindOneAndDelete(mongoCtx, bson.M{
+		"state": hashToken(callbackData.State), "expiresAt": bson.M{"$gt": time.Now().UTC()},
+	}).Decode(&state)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, `{"error":"Login session expired! Please try again."}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	provider := findOIDCProvider(config.OIDC, state.Provider)
+	if provider == nil {
+		http.Error(w, `{"error":"Unknown login provider!"}`, http.StatusNotFound)
+		return
+	}
+	discovery, err := oidcProviderMetadata(provider)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Login provider is unavailable!"}`, http.StatusBadGateway)
+		return
+	}
+	idToken, accessToken, err := exchangeOIDCCode(provider, discovery, callbackData.Code, state.CodeVerifier)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Login provider rejected the login!"}`, http.StatusUnauthorized)
+		return
+	}
+	claims, err := verifyIDToken(provider, idToken, state.Nonce)
+	if err != nil {
+		log.Println(provider.Name, err)
+		http.Error(w, `{"error":"Login provider returned an invalid ID token!"}`, http.StatusUnauthorized)
+		return
+	}
+	// Some providers only include the email in the userinfo response.
+	if claims.Email == "" && discovery.UserinfoEndpoint != "" && accessToken != "" {
+		var userinfo IDTokenClaims
+		err = oidcGetJSON(discovery.UserinfoEndpoint, accessToken, &userinfo)
+		if err != nil {
+			log.Println(err)
+		} else if userinfo.Subject == claims.Subject {
+			claims.Email, claims.EmailVerified = userinfo.Email, userinfo.EmailVerified
+			if claims.PreferredUsername == "" {
+				claims.PreferredUsername = userinfo.PreferredUsername
+			}
+		}
+	}
+	user, message, err := findOIDCUser(r, provider, claims)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if message != "" {
+		errorJson, _ := json.Marshal(map[string]string{"error": message})
+		http.Error(w, string(errorJson), http.StatusForbidden)
+		return
+	} else if !user.DeleteAfter.IsZero() {
+		recordAuditEvent(r, user.Username, auditLogin, auditFailure, "Account pending deletion")
+		http.Error(w, `{"error":"This account has been deleted! Check your email to restore it."}`, http.StatusForbidden)
+		return
+	} else if user.Disabled {
+		recordAuditEvent(r, user.Username, auditLogin, auditFailure, "Account disabled")
+		http.Error(w, `{"error":"This account has been disabled!"}`, http.StatusForbidden)
+		return
+	} else if user.SuspendedUntil.After(time.Now()) {
+		recordAuditEvent(r, user.Username, auditLogin, auditFailure, "Account suspended")
+		writeAccountSuspended(w, user.SuspendedUntil, user.SuspensionReason)
+		return
+	} else if user.TOTPSecret != "" {
+		createLoginChallenge(w, user.Username)
+		return
+	}
+	completeLogin(w, r, user.Username, "oidc:"+provider.Name)
+}
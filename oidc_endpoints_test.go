@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testOIDCProvider is a fake OpenID Connect provider serving discovery and a JWKS, which signs its own ID tokens.
+type testOIDCProvider struct {
+	server      *httptest.Server
+	config      *OIDCProviderConfig
+	rsaKey      *rsa.PrivateKey
+	ecKey       *ecdsa.PrivateKey
+	mutex       sync.Mutex
+	keys        []oidcJWK
+	discoveries int
+	jwksFetches int
+}
+
+func encodeBigInt(i *big.Int, size int) string {
+	bytes := make([]byte, size)
+	return base64.RawURLEncoding.EncodeToString(i.FillBytes(bytes))
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testOIDCProvider{rsaKey: rsaKey, ecKey: ecKey}
+	p.keys = []oidcJWK{
+		{
+			Kty: "RSA", Kid: "rsa", Use: "sig", Alg: "RS256",
+			N: encodeBigInt(rsaKey.N, rsaKey.Size()), E: encodeBigInt(big.NewInt(int64(rsaKey.E)), 3),
+		},
+		{
+			Kty: "EC", Kid: "ec", Use: "sig", Alg: "ES256", Crv: "P-256",
+			X: encodeBigInt(ecKey.X, 32), Y: encodeBigInt(ecKey.Y, 32),
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		p.mutex.Lock()
+		p.discoveries++
+		p.mutex.Unlock()
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                p.server.URL,
+			AuthorizationEndpoint: p.server.URL + "/authorize",
+			TokenEndpoint:         p.server.URL + "/token",
+			JWKSURI:               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.jwksFetches++
+		json.NewEncoder(w).Encode(map[string][]oidcJWK{"keys": p.keys})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	p.config = &OIDCProviderConfig{Name: "test", Issuer: p.server.URL, ClientID: "cerulean"}
+	resetOIDCCache(t)
+	return p
+}
+
+func resetOIDCCache(t *testing.T) {
+	oidcCacheMutex.Lock()
+	oidcCache = map[string]*oidcProviderState{}
+	oidcCacheMutex.Unlock()
+	t.Cleanup(func() {
+		oidcCacheMutex.Lock()
+		oidcCache = map[string]*oidcProviderState{}
+		oidcCacheMutex.Unlock()
+	})
+}
+
+func (p *testOIDCProvider) claims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            p.server.URL,
+		"sub":            "subject",
+		"aud":            p.config.ClientID,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "user@example.com",
+		"email_verified": true,
+	}
+}
+
+func (p *testOIDCProvider) sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	var err error
+	if alg == "RS256" {
+		signature, err = rsa.SignPKCS1v15(rand.Reader, p.rsaKey, crypto.SHA256, digest[:])
+	} else {
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, p.ecKey, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestParseOIDCKey(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	key, err := parseOIDCKey(p.keys[0], "RS256")
+	if err != nil {
+		t.Fatal(err)
+	} else if rsaKey, ok := key.(*rsa.PublicKey); !ok || !rsaKey.Equal(&p.rsaKey.PublicKey) {
+		t.Errorf("RS256 key was parsed as %v", key)
+	}
+	key, err = parseOIDCKey(p.keys[1], "ES256")
+	if err != nil {
+		t.Fatal(err)
+	} else if ecKey, ok := key.(*ecdsa.PublicKey); !ok || !ecKey.Equal(&p.ecKey.PublicKey) {
+		t.Errorf("ES256 key was parsed as %v", key)
+	}
+
+	offCurve := p.keys[1]
+	offCurve.Y = offCurve.X
+	invalid := map[string]struct {
+		key oidcJWK
+		alg string
+	}{
+		"alg mismatch":    {p.keys[0], "ES256"},
+		"missing modulus": {oidcJWK{Kty: "RSA", E: "AQAB"}, "RS256"},
+		"small exponent":  {oidcJWK{Kty: "RSA", N: p.keys[0].N, E: "AQ"}, "RS256"},
+		"point off curve": {offCurve, "ES256"},
+		"wrong curve":     {oidcJWK{Kty: "EC", Crv: "P-384", X: p.keys[1].X, Y: p.keys[1].Y}, "ES256"},
+		"unsupported alg": {p.keys[0], "HS256"},
+	}
+	for name, test := range invalid {
+		if _, err := parseOIDCKey(test.key, test.alg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestOIDCProviderMetadata(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			discovery, err := oidcProviderMetadata(p.config)
+			if err != nil {
+				t.Error(err)
+			} else if discovery.JWKSURI != p.server.URL+"/jwks" {
+				t.Errorf("unexpected JWKS URI %s", discovery.JWKSURI)
+			}
+		}()
+	}
+	wg.Wait()
+	discoveries := p.discoveries
+	if _, err := oidcProviderMetadata(p.config); err != nil {
+		t.Fatal(err)
+	} else if p.discoveries != discoveries {
+		t.Error("discovery document was fetched again after it was cached")
+	}
+
+	resetOIDCCache(t)
+	wrongIssuer := *p.config
+	wrongIssuer.Name, wrongIssuer.Issuer = "wrong", p.server.URL+"/other"
+	if _, err := oidcProviderMetadata(&wrongIssuer); err == nil {
+		t.Error("expected an error for a discovery document from another issuer")
+	}
+	oidcCacheMutex.Lock()
+	_, cached := oidcCache["wrong"]
+	oidcCacheMutex.Unlock()
+	if cached {
+		t.Error("invalid discovery document was cached")
+	}
+}
+
+func TestOIDCMetadataDoesNotBlockOtherProviders(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.NotFound(w, r)
+	}))
+	defer slow.Close()
+	defer close(release)
+	go oidcProviderMetadata(&OIDCProviderConfig{Name: "slow", Issuer: slow.URL, ClientID: "cerulean"})
+	time.Sleep(time.Millisecond * 50)
+
+	done := make(chan error)
+	go func() {
+		_, err := oidcProviderMetadata(p.config)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("fetching metadata was blocked by another provider")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	if _, err := oidcProviderMetadata(p.config); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ alg, kid string }{{"RS256", "rsa"}, {"ES256", "ec"}, {"RS256", ""}} {
+		claims, err := verifyIDToken(p.config, p.sign(t, test.alg, test.kid, p.claims("nonce")), "nonce")
+		if err != nil {
+			t.Errorf("%s: %v", test.alg, err)
+		} else if claims.Subject != "subject" || claims.Email != "user@example.com" || !claims.emailVerified() {
+			t.Errorf("%s: unexpected claims %+v", test.alg, claims)
+		}
+	}
+
+	modify := func(key string, value interface{}) map[string]interface{} {
+		claims := p.claims("nonce")
+		claims[key] = value
+		return claims
+	}
+	invalid := map[string]string{
+		"wrong nonce":      p.sign(t, "RS256", "rsa", p.claims("other")),
+		"wrong issuer":     p.sign(t, "RS256", "rsa", modify("iss", "https://attacker.example")),
+		"wrong audience":   p.sign(t, "RS256", "rsa", modify("aud", "other")),
+		"missing azp":      p.sign(t, "RS256", "rsa", modify("aud", []string{"cerulean", "other"})),
+		"expired":          p.sign(t, "ES256", "ec", modify("exp", time.Now().Add(-time.Hour).Unix())),
+		"issued in future": p.sign(t, "ES256", "ec", modify("iat", time.Now().Add(time.Hour).Unix())),
+		"missing subject":  p.sign(t, "ES256", "ec", modify("sub", "")),
+		"unknown kid":      p.sign(t, "RS256", "unknown", p.claims("nonce")),
+		"alg mismatch":     p.sign(t, "ES256", "rsa", p.claims("nonce")),
+		"malformed":        "not.a-token",
+	}
+	// Swapping in another payload must break the signature.
+	parts := strings.Split(p.sign(t, "RS256", "rsa", p.claims("nonce")), ".")
+	forged := strings.Split(p.sign(t, "RS256", "rsa", modify("sub", "admin")), ".")
+	invalid["forged payload"] = parts[0] + "." + forged[1] + "." + parts[2]
+	for name, idToken := range invalid {
+		if _, err := verifyIDToken(p.config, idToken, "nonce"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	claims := modify("aud", []string{"cerulean", "other"})
+	claims["azp"] = "cerulean"
+	if _, err := verifyIDToken(p.config, p.sign(t, "RS256", "rsa", claims), "nonce"); err != nil {
+		t.Errorf("multiple audiences with azp: %v", err)
+	}
+}
+
+func TestOIDCSigningKeyRotation(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	if _, err := oidcProviderMetadata(p.config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyIDToken(p.config, p.sign(t, "RS256", "rsa", p.claims("nonce")), "nonce"); err != nil {
+		t.Fatal(err)
+	}
+	// A key rotated in less than a minute after the last fetch isn't picked up, so unknown key IDs can't be
+	// used to make us fetch the JWKS on every request.
+	p.mutex.Lock()
+	p.keys[0].Kid = "rotated"
+	p.mutex.Unlock()
+	idToken := p.sign(t, "RS256", "rotated", p.claims("nonce"))
+	if _, err := verifyIDToken(p.config, idToken, "nonce"); err == nil {
+		t.Error("expected an error for a key rotated less than a minute ago")
+	} else if p.jwksFetches != 1 {
+		t.Errorf("JWKS was fetched %d times, expected 1", p.jwksFetches)
+	}
+	oidcCacheMutex.Lock()
+	oidcCache[p.config.Name].keysFetchedAt = time.Now().Add(-time.Minute * 2)
+	oidcCacheMutex.Unlock()
+	if _, err := verifyIDToken(p.config, idToken, "nonce"); err != nil {
+		t.Error(err)
+	} else if p.jwksFetches != 2 {
+		t.Errorf("JWKS was fetched %d times, expected 2", p.jwksFetches)
+	}
+}
+
+// connectTestDatabase connects to the MongoDB replica set in CERULEAN_TEST_MONGO_URI, and skips the test if
+// it isn't set. The database is dropped when the test finishes.
+func connectTestDatabase(t *testing.T) {
+	uri := os.Getenv("CERULEAN_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("CERULEAN_TEST_MONGO_URI is not set")
+	}
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mongodb, mongoCtx = client, context.Background()
+	database = client.Database("cerulean_test")
+	t.Cleanup(func() {
+		database.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+}
+
+func TestFindOIDCUserLinksByEmail(t *testing.T) {
+	connectTestDatabase(t)
+	provider := &OIDCProviderConfig{Name: "test"}
+	r := httptest.NewRequest("POST", "/login/oidc/callback", nil)
+	_, err := database.Collection("users").InsertMany(mongoCtx, []interface{}{
+		bson.M{"username": "verified", "email": "verified@example.com", "verified": "", "todos": bson.A{}},
+		bson.M{"username": "unverified", "email": "unverified@example.com", "verified": "token", "todos": bson.A{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := &IDTokenClaims{Subject: "subject", Email: "verified@example.com", EmailVerified: "true"}
+	user, message, err := findOIDCUser(r, provider, claims)
+	if err != nil || message != "" {
+		t.Fatal(err, message)
+	} else if user.Username != "verified" {
+		t.Fatalf("linked to %s instead of verified", user.Username)
+	}
+	// The identity stays linked if the email changes at the provider.
+	claims.Email = "changed@example.com"
+	user, message, err = findOIDCUser(r, provider, claims)
+	if err != nil || message != "" {
+		t.Fatal(err, message)
+	} else if user.Username != "verified" {
+		t.Fatalf("found %s instead of verified", user.Username)
+	}
+
+	// Accounts which haven't proven they own the email must not be taken over.
+	_, message, err = findOIDCUser(r, provider, &IDTokenClaims{
+		Subject: "other", Email: "unverified@example.com", EmailVerified: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if message == "" {
+		t.Error("linked to an account with an unverified email")
+	}
+	// Nor should emails the provider hasn't verified.
+	_, message, err = findOIDCUser(r, provider, &IDTokenClaims{
+		Subject: "another", Email: "verified@example.com", EmailVerified: false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if message == "" {
+		t.Error("linked with an email the provider has not verified")
+	}
+	count, err := database.Collection("users").CountDocuments(mongoCtx, bson.M{"oidcIdentities.provider": "test"})
+	if err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Errorf("%d users have linked identities, expected 1", count)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// checkPasswordPolicy returns the reasons a new password is not allowed, or nil if it is.
+func checkPasswordPolicy(password string, username string, email string) ([]string, error) {
+	reasons := []string{}
+	length := utf8.RuneCountInString(password)
+	if length < config.Password.MinLength {
+		reasons = append(reasons, fmt.Sprintf("Password must be at least %d characters long.", config.Password.MinLength))
+	} else if length > config.Password.MaxLength {
+		reasons = append(reasons, fmt.Sprintf("Password must be at most %d characters long.", config.Password.MaxLength))
+	}
+	lowerPassword := strings.ToLower(password)
+	if username != "" && strings.Contains(lowerPassword, strings.ToLower(username)) {
+		reasons = append(reasons, "Password must not contain your username.")
+	}
+	if at := strings.LastIndex(email, "@"); at >= 4 && strings.Contains(lowerPassword, strings.ToLower(email[:at])) {
+		reasons = append(reasons, "Password must not contain your email address.")
+	}
+	if breachedPasswords != nil {
+		breached, err := breachedPasswords.contains(password)
+		if err != nil {
+			return nil, err
+		} else if breached {
+			reasons = append(reasons, "This password has appeared in a data breach, please choose a different one.")
+		}
+	}
+	if len(reasons) == 0 {
+		return nil, nil
+	}
+	return reasons, nil
+}
+
+func writePasswordPolicyError(w http.ResponseWriter, field string, reasons []string) {
+	errorJson, _ := json.Marshal(map[string]interface{}{
+		"error":  "Password does not meet the requirements!",
+		"fields": map[string][]string{field: reasons},
+	})
+	http.Error(w, string(errorJson), http.StatusBadRequest)
+}
+
+// breachedPasswordList is a file of uppercase hex SHA-1 hashes of breached passwords, sorted with one per line,
+// such as the Pwned Passwords list. Lines may be prefixes of the same length, and anything after a colon
+// (e.g. the number of times a password was seen) is ignored. The file is binary searched instead of loaded.
+type breachedPasswordList struct {
+	file *os.File
+	size int64
+}
+
+var breachedPasswords *breachedPasswordList
+
+const breachedPasswordMaxLine = 256
+
+func openBreachedPasswordList(path string) (*breachedPasswordList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &breachedPasswordList{file: file, size: info.Size()}, nil
+}
+
+// lineAt returns the first line starting at or after an offset, and where it starts.
+func (l *breachedPasswordList) lineAt(offset int64) (string, int64, error) {
+	start := offset
+	if offset > 0 {
+		start = offset - 1
+	}
+	buffer := make([]byte, breachedPasswordMaxLine*2)
+	n, err := l.file.ReadAt(buffer, start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", 0, err
+	}
+	buffer = buffer[:n]
+	if offset > 0 {
+		newline := bytes.IndexByte(buffer, '\n')
+		if newline < 0 {
+			return "", l.size, nil
+		}
+		buffer = buffer[newline+1:]
+		start += int64(newline + 1)
+	}
+	if end := bytes.IndexByte(buffer, '\n'); end >= 0 {
+		buffer = buffer[:end]
+	} else if start+int64(len(buffer)) < l.size {
+		return "", 0, errors.New("breached password file has a line which is too long")
+	}
+	line := strings.TrimSpace(string(buffer))
+	if colon := strings.IndexByte(line, ':'); colon >= 0 {
+		line = line[:colon]
+	}
+	return strings.ToUpper(line), start, nil
+}
+
+func (l *breachedPasswordList) contains(password string) (bool, error) {
+	digest := sha1.Sum([]byte(password))
+	target := strings.ToUpper(hex.EncodeToString(digest[:]))
+	compare := func(hash string) int {
+		if len(hash) > len(target) {
+			return strings.Compare(hash, target)
+		}
+		return strings.Compare(hash, target[:len(hash)])
+	}
+	// The matching line, if any, always starts in [low, high).
+	low, high := int64(0), l.size
+	for high-low > breachedPasswordMaxLine {
+		middle := (low + high) / 2
+		hash, start, err := l.lineAt(middle)
+		if err != nil {
+			return false, err
+		} else if start >= high {
+			high = middle
+		} else if compare(hash) <= 0 {
+			low = start
+		} else {
+			high = start
+		}
+	}
+	for offset := low; offset < high; {
+		hash, start, err := l.lineAt(offset)
+		if err != nil {
+			return false, err
+		} else if start >= high {
+			break
+		} else if hash != "" && compare(hash) == 0 {
+			return true, nil
+		}
+		offset = start + 1
+	}
+	return false, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/argon2"
+)
+
+// Passwords are hashed with argon2id and stored in PHC string format, which records the parameters
+// used alongside the salt and hash, e.g. $argon2id$v=19$m=51200,t=1,p=4$<salt>$<hash>.
+
+type PasswordConfig struct {
+	Memory       uint32 `json:"memory"` // In KiB.
+	Iterations   uint32 `json:"iterations"`
+	Parallelism  uint8  `json:"parallelism"`
+	MinLength    int    `json:"minLength"`
+	MaxLength    int    `json:"maxLength"`
+	BreachedFile string `json:"breachedFile"`
+}
+
+// hashParams returns only the parameters which affect password hashes.
+func (c PasswordConfig) hashParams() PasswordConfig {
+	return PasswordConfig{Memory: c.Memory, Iterations: c.Iterations, Parallelism: c.Parallelism}
+}
+
+func (c *PasswordConfig) setDefaults() error {
+	if c.Memory == 0 {
+		c.Memory = 50 * 1024
+	}
+	if c.Iterations == 0 {
+		c.Iterations = 1
+	}
+	if c.Parallelism == 0 {
+		c.Parallelism = 4
+	}
+	if c.Memory < 8*uint32(c.Parallelism) {
+		return fmt.Errorf("password.memory must be at least 8 KiB per thread")
+	}
+	if c.MinLength <= 0 {
+		c.MinLength = 8
+	}
+	if c.MaxLength <= 0 {
+		c.MaxLength = 256
+	} else if c.MaxLength < c.MinLength {
+		return fmt.Errorf("password.maxLength must not be less than password.minLength")
+	}
+	return nil
+}
+
+const passwordSaltLength = 16
+const passwordKeyLength = 32
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	params := config.Password
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, passwordKeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// verifyPassword checks a password against a stored hash, and reports whether the hash should be replaced
+// because it uses outdated parameters. legacySalt is the salt stored separately by older versions.
+func verifyPassword(password string, encoded string, legacySalt string) (bool, bool) {
+	if !strings.HasPrefix(encoded, "$") {
+		key := argon2.IDKey([]byte(password), []byte(legacySalt), 1, 50*1024, 4, 32)
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(key)), []byte(encoded)) == 1, true
+	}
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return false, false
+	}
+	var params PasswordConfig
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	// Refuse unreasonable parameters rather than spending minutes hashing.
+	if err != nil || params.Parallelism == 0 || params.Iterations == 0 || params.Iterations > 64 || params.Memory > 4*1024*1024 {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(hash) == 0 {
+		return false, false
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(hash)))
+	if subtle.ConstantTimeCompare(key, hash) != 1 {
+		return false, false
+	}
+	return true, params != config.Password.hashParams() || len(salt) != passwordSaltLength || len(hash) != passwordKeyLength
+}
+
+// rehashPassword replaces a user's password hash with one using the current parameters.
+func rehashPassword(user *UserDocument, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	// Don't overwrite the password if it was changed since the user was fetched.
+	_, err = database.Collection("users").UpdateOne(
+		mongoCtx,
+		bson.M{"username": user.Username, "password": user.Password},
+		bson.M{"$set": bson.M{"password": hash}, "$unset": bson.M{"salt": 1}},
+	)
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	defer func(password PasswordConfig) { config.Password = password }(config.Password)
+	config.Password = PasswordConfig{}
+	if err := config.Password.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	legacyHash := hex.EncodeToString(argon2.IDKey([]byte("password123"), []byte("legacysalt"), 1, 50*1024, 4, 32))
+	currentHash, err := hashPassword("password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Password.Iterations = 2
+	outdatedHash, err := hashPassword("password123")
+	config.Password.Iterations = 1
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		password   string
+		encoded    string
+		legacySalt string
+		ok         bool
+		rehash     bool
+	}{
+		{"legacy hash", "password123", legacyHash, "legacysalt", true, true},
+		{"legacy hash with wrong password", "password124", legacyHash, "legacysalt", false, true},
+		{"current parameters", "password123", currentHash, "", true, false},
+		{"outdated parameters", "password123", outdatedHash, "", true, true},
+		{"wrong password", "password124", currentHash, "", false, false},
+		{"wrong algorithm", "password123", "$argon2i" + currentHash[len("$argon2id"):], "", false, false},
+		{"missing hash", "password123", currentHash[:len(currentHash)-44], "", false, false},
+		{"malformed parameters", "password123", "$argon2id$v=19$m=51200,t=x,p=4$c2FsdA$aGFzaA", "", false, false},
+		{"unreasonable parameters", "password123", "$argon2id$v=19$m=51200,t=1000,p=4$c2FsdA$aGFzaA", "", false, false},
+		{"malformed salt", "password123", "$argon2id$v=19$m=51200,t=1,p=4$!!!$aGFzaA", "", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, rehash := verifyPassword(test.password, test.encoded, test.legacySalt)
+			if ok != test.ok || rehash != test.rehash {
+				t.Errorf("got ok=%v rehash=%v, want ok=%v rehash=%v", ok, rehash, test.ok, test.rehash)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Clients can be made to solve a hashcash-style challenge before registering or logging in, which makes
+// scripted sign-ups and password guessing expensive without a third-party CAPTCHA. A challenge is signed with
+// its difficulty and expiry, so it doesn't need to be stored until it's used. The client must find a nonce
+// where the SHA-256 digest of the challenge followed by the nonce starts with at least difficulty zero bits.
+// Solved challenges are stored until they expire, so each one can only be used once.
+
+const maxProofOfWorkNonceLength = 64
+
+type ProofOfWorkConfig struct {
+	Register           bool     `json:"register"`
+	LoginAfterFailures int      `json:"loginAfterFailures"`
+	Difficulty         int      `json:"difficulty"`
+	Lifetime           Duration `json:"lifetime"`
+}
+
+func (c *ProofOfWorkConfig) setDefaults() error {
+	if c.Difficulty == 0 {
+		c.Difficulty = 20
+	} else if c.Difficulty < 1 || c.Difficulty > 32 {
+		return fmt.Errorf("proofOfWork.difficulty must be between 1 and 32")
+	}
+	if c.Lifetime.Duration < 0 {
+		return fmt.Errorf("proofOfWork.lifetime must not be negative")
+	} else if c.Lifetime.Duration == 0 {
+		c.Lifetime.Duration = time.Minute * 5
+	}
+	if c.LoginAfterFailures < 0 {
+		return fmt.Errorf("proofOfWork.loginAfterFailures must not be negative")
+	}
+	return nil
+}
+
+func signProofOfWorkChallenge(payload string) string {
+	mac := hmac.New(sha256.New, deriveKey("proof-of-work"))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newProofOfWorkChallenge returns a challenge of the form difficulty.expiry.random.signature.
+func newProofOfWorkChallenge(expiresAt time.Time) (string, error) {
+	bytes, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	payload := strconv.Itoa(config.ProofOfWork.Difficulty) + "." +
+		strconv.FormatInt(expiresAt.Unix(), 10) + "." + hex.EncodeToString(bytes[:16])
+	return payload + "." + signProofOfWorkChallenge(payload), nil
+}
+
+// leadingZeroBits counts the zero bits at the start of a digest.
+func leadingZeroBits(digest []byte) int {
+	count := 0
+	for _, b := range digest {
+		count += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return count
+}
+
+// verifyProofOfWork checks the signature, expiry and difficulty of a challenge, and that the nonce solves it.
+// It returns when the challenge expires, or a zero time if the solution is invalid.
+func verifyProofOfWork(challenge string, nonce string) time.Time {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 || nonce == "" || len(nonce) > maxProofOfWorkNonceLength {
+		return time.Time{}
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(signProofOfWorkChallenge(payload))) {
+		return time.Time{}
+	}
+	difficulty, err := strconv.Atoi(parts[0])
+	if err != nil || difficulty < config.ProofOfWork.Difficulty {
+		return time.Time{}
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !time.Unix(expiry, 0).After(time.Now()) {
+		return time.Time{}
+	}
+	digest := sha256.Sum256([]byte(challenge + nonce))
+	if leadingZeroBits(digest[:]) < difficulty {
+		return time.Time{}
+	}
+	return time.Unix(expiry, 0).UTC()
+}
+
+// writeChallengeRequired responds with a 403 that clients can tell apart from other errors by its code, so
+// they know to solve a challenge from GET /challenge and try again.
+func writeChallengeRequired(w http.ResponseWriter, message string) {
+	errorJson, _ := json.Marshal(map[string]string{"error": message, "code": "challenge_required"})
+	http.Error(w, string(errorJson), http.StatusForbidden)
+}
+
+// checkProofOfWork checks a solved challenge and uses it up, writing an error if it is missing or invalid.
+func checkProofOfWork(w http.ResponseWriter, challenge string, nonce string) bool {
+	if challenge == "" {
+		writeChallengeRequired(w, "Solve a challenge to continue!")
+		return false
+	}
+	expiresAt := verifyProofOfWork(challenge, nonce)
+	if expiresAt.IsZero() {
+		writeChallengeRequired(w, "Invalid or expired challenge solution!")
+		return false
+	}
+	_, err := database.Collection("used_challenges").InsertOne(mongoCtx, UsedChallengeDocument{
+		Challenge: hashToken(challenge),
+		ExpiresAt: expiresAt,
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		writeChallengeRequired(w, "This challenge has already been used!")
+		return false
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func getChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		http.Error(w, `{"error":"Allowed methods: GET"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	expiresAt := time.Now().UTC().Add(config.ProofOfWork.Lifetime.Duration).Truncate(time.Second)
+	challenge, err := newProofOfWorkChallenge(expiresAt)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Challenge  string    `json:"challenge"`
+		Difficulty int       `json:"difficulty"`
+		ExpiresAt  time.Time `json:"expiresAt"`
+	}{Challenge: challenge, Difficulty: config.ProofOfWork.Difficulty, ExpiresAt: expiresAt})
+}
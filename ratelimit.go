@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Requests are rate limited with token buckets, keyed by the authenticated user or else the client IP.
+// Each bucket holds up to Requests tokens and is refilled at a rate of Requests per Period.
+
+type RateLimitPolicy struct {
+	Requests int      `json:"requests"`
+	Period   Duration `json:"period"`
+}
+
+type RateLimitConfig struct {
+	Store   string                     `json:"store"`
+	Default RateLimitPolicy            `json:"default"`
+	Routes  map[string]RateLimitPolicy `json:"routes"`
+}
+
+func (c *RateLimitConfig) setDefaults() error {
+	if c.Default.Requests <= 0 {
+		c.Default.Requests = 120
+	}
+	if c.Default.Period.Duration <= 0 {
+		c.Default.Period.Duration = time.Minute
+	}
+	for route, policy := range c.Routes {
+		if policy.Requests <= 0 || policy.Period.Duration <= 0 {
+			return fmt.Errorf("rate limit for %s must have a positive requests and period", route)
+		}
+	}
+	return nil
+}
+
+func (c *RateLimitConfig) policy(route string) RateLimitPolicy {
+	if policy, ok := c.Routes[route]; ok {
+		return policy
+	}
+	return c.Default
+}
+
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	Reset     time.Duration // Time until the bucket is full again.
+	RetryIn   time.Duration // Time until the next request is allowed, if it was not allowed.
+}
+
+func newRateLimitResult(tokens float64, allowed bool, policy RateLimitPolicy) RateLimitResult {
+	perToken := policy.Period.Duration / time.Duration(policy.Requests)
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Remaining: int(tokens),
+		Reset:     time.Duration((float64(policy.Requests) - tokens) * float64(perToken)),
+	}
+	if !allowed {
+		result.RetryIn = time.Duration((1 - tokens) * float64(perToken))
+	}
+	return result
+}
+
+// RateLimitStore is implemented by everything that can store token buckets.
+type RateLimitStore interface {
+	Take(key string, policy RateLimitPolicy) (RateLimitResult, error)
+}
+
+var rateLimitStore RateLimitStore
+
+func newRateLimitStore(config RateLimitConfig) (RateLimitStore, error) {
+	switch config.Store {
+	case "memory", "":
+		return &memoryRateLimitStore{buckets: map[string]*memoryBucket{}}, nil
+	case "mongo":
+		return &mongoRateLimitStore{}, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store: %s", config.Store)
+	}
+}
+
+// memoryRateLimitStore keeps buckets in memory, so limits are only enforced per instance.
+type memoryRateLimitStore struct {
+	mutex     sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+func (s *memoryRateLimitStore) Take(key string, policy RateLimitPolicy) (RateLimitResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	nowTime := time.Now()
+	// Forget buckets which have refilled, so memory use doesn't grow forever.
+	if nowTime.Sub(s.lastSweep) >= time.Minute {
+		for bucketKey, bucket := range s.buckets {
+			if nowTime.After(bucket.fullAt) {
+				delete(s.buckets, bucketKey)
+			}
+		}
+		s.lastSweep = nowTime
+	}
+	capacity := float64(policy.Requests)
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: capacity, updatedAt: nowTime}
+		s.buckets[key] = bucket
+	}
+	refill := nowTime.Sub(bucket.updatedAt).Seconds() * capacity / policy.Period.Seconds()
+	bucket.tokens = math.Min(capacity, bucket.tokens+refill)
+	bucket.updatedAt = nowTime
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+	result := newRateLimitResult(bucket.tokens, allowed, policy)
+	bucket.fullAt = nowTime.Add(result.Reset)
+	return result, nil
+}
+
+// mongoRateLimitStore keeps buckets in the rate_limits collection, so limits are shared between instances.
+type mongoRateLimitStore struct{}
+
+func (s *mongoRateLimitStore) Take(key string, policy RateLimitPolicy) (RateLimitResult, error) {
+	nowTime := time.Now().UTC()
+	capacity := float64(policy.Requests)
+	tokensPerMs := capacity / float64(policy.Period.Milliseconds())
+	// The bucket is refilled and a token taken in a single atomic update, which also sets when the bucket will
+	// be full again, so the TTL index can remove it.
+	tokens := bson.M{"$cond": bson.A{
+		bson.M{"$gte": bson.A{"$tokens", 1}}, bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens",
+	}}
+	after := options.After
+	upsert := true
+	var document RateLimitDocument
+	err := database.Collection("rate_limits").FindOneAndUpdate(
+		mongoCtx,
+		bson.M{"_id": key},
+		bson.A{
+			bson.M{"$set": bson.M{
+				"tokens": bson.M{"$min": bson.A{capacity, bson.M{"$add": bson.A{
+					bson.M{"$ifNull": bson.A{"$tokens", capacity}},
+					bson.M{"$multiply": bson.A{
+						bson.M{"$subtract": bson.A{nowTime, bson.M{"$ifNull": bson.A{"$updatedAt", nowTime}}}},
+						tokensPerMs,
+					}},
+				}}}},
+				"updatedAt": nowTime,
+			}},
+			bson.M{"$set": bson.M{
+				"allowed": bson.M{"$gte": bson.A{"$tokens", 1}},
+				"tokens":  tokens,
+				"expiresAt": bson.M{"$add": bson.A{
+					nowTime, bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{capacity, tokens}}, tokensPerMs}},
+				}},
+			}},
+		},
+		&options.FindOneAndUpdateOptions{ReturnDocument: &after, Upsert: &upsert},
+	).Decode(&document)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return newRateLimitResult(document.Tokens, document.Allowed, policy), nil
+}
+
+type authContextKey struct{}
+
+type authResult struct {
+	token    string
+	username string
+	scopes   []string
+}
+
+// rateLimit limits requests to a route by IP address, according to the policy for it in config.json.
+func rateLimit(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		takeRateLimit(w, r, config.RateLimit.policy(route), route+":ip:"+clientIP(r), handler)
+	})
+}
+
+// rateLimitUser is rateLimit for routes which require logging in, where each user gets their own limit. Tokens
+// are only looked up for these routes, since handleLoginCheck would look them up anyway, and it reuses the result.
+func rateLimitUser(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := route + ":ip:" + clientIP(r)
+		if token, _ := requestToken(r); token != "" {
+			username, scopes, err := authenticate(token)
+			// Suspended accounts are limited by IP, and rejected by handleLoginCheck.
+			var suspended *accountSuspendedError
+			if err != nil && !errors.As(err, &suspended) {
+				log.Println(err)
+				http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+				return
+			} else if username != "" {
+				key = route + ":user:" + username
+				r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, authResult{
+					token: token, username: username, scopes: scopes,
+				}))
+			}
+		}
+		takeRateLimit(w, r, config.RateLimit.policy(route), key, handler)
+	})
+}
+
+func takeRateLimit(w http.ResponseWriter, r *http.Request, policy RateLimitPolicy, key string, handler http.Handler) {
+	result, err := rateLimitStore.Take(key, policy)
+	if err != nil {
+		// Don't take the whole API down if the store is unavailable.
+		log.Println(err)
+		handler.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(policy.Requests))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Requests, int(policy.Period.Seconds())))
+	if !result.Allowed {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryIn.Seconds()))))
+		http.Error(w, `{"error":"Too many requests! Please slow down."}`, http.StatusTooManyRequests)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const registrationOpen = "open"
+const registrationClosed = "closed"
+const registrationInvite = "invite"
+const registrationDomain = "domain"
+
+const inviteDefaultLifetime = time.Hour * 24 * 7
+const inviteMaxLifetime = time.Hour * 24 * 90
+const inviteMaxUses = 1000
+
+var errInvalidInvite = errors.New("invalid invite")
+
+type RegistrationConfig struct {
+	Mode             string   `json:"mode"`
+	AllowedDomains   []string `json:"allowedDomains"`
+	AdminOnlyInvites bool     `json:"adminOnlyInvites"`
+	InviteRetention  Duration `json:"inviteRetention"`
+}
+
+func (c *RegistrationConfig) setDefaults() error {
+	if c.Mode == "" {
+		c.Mode = registrationOpen
+	} else if c.Mode != registrationOpen && c.Mode != registrationClosed &&
+		c.Mode != registrationInvite && c.Mode != registrationDomain {
+		return fmt.Errorf("unknown registration.mode: %s", c.Mode)
+	}
+	if c.Mode == registrationDomain && len(c.AllowedDomains) == 0 {
+		return fmt.Errorf("registration.allowedDomains must not be empty when registration.mode is domain")
+	}
+	for i, domain := range c.AllowedDomains {
+		c.AllowedDomains[i] = strings.ToLower(strings.TrimPrefix(domain, "@"))
+	}
+	if c.InviteRetention.Duration < 0 {
+		return fmt.Errorf("registration.inviteRetention must not be negative")
+	} else if c.InviteRetention.Duration == 0 {
+		c.InviteRetention.Duration = time.Hour * 24 * 90
+	}
+	return nil
+}
+
+// registrationError returns why a new account can't be created with an email address under the registration
+// mode, or an empty string if it can. Invites are checked when the account is created, since they are used up.
+func registrationError(email string) string {
+	switch config.Registration.Mode {
+	case registrationClosed:
+		return "Registration is closed!"
+	case registrationDomain:
+		domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+		if !hasScope(config.Registration.AllowedDomains, domain) {
+			return "Registration is limited to email addresses from certain domains!"
+		}
+	}
+	return ""
+}
+
+// insertInvitedUser creates a user and uses up one use of their invite, returning errInvalidInvite if the
+// invite doesn't exist, has expired or has been used up.
+func insertInvitedUser(user bson.M, invite string) error {
+	session, err := mongodb.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+	_, err = session.WithTransaction(context.Background(), func(ctx mongo.SessionContext) (interface{}, error) {
+		err := database.Collection("invites").FindOneAndUpdate(ctx, bson.M{
+			"code":      hashToken(invite),
+			"usesLeft":  bson.M{"$gt": 0},
+			"expiresAt": bson.M{"$gt": time.Now().UTC()},
+		}, bson.M{
+			"$inc":  bson.M{"usesLeft": -1},
+			"$push": bson.M{"usedBy": user["username"]},
+		}).Err()
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errInvalidInvite
+		} else if err != nil {
+			return nil, err
+		}
+		_, err = database.Collection("users").InsertOne(ctx, user)
+		return nil, err
+	})
+	return err
+}
+
+func getRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		http.Error(w, `{"error":"Allowed methods: GET"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	data := struct {
+		Mode           string   `json:"mode"`
+		AllowedDomains []string `json:"allowedDomains,omitempty"`
+	}{Mode: config.Registration.Mode}
+	if config.Registration.Mode == registrationDomain {
+		data.AllowedDomains = config.Registration.AllowedDomains
+	}
+	json.NewEncoder(w).Encode(data)
+}
+
+type InviteData struct {
+	ID        string    `json:"id"`
+	Code      string    `json:"code,omitempty"`
+	CreatedBy string    `json:"createdBy"`
+	MaxUses   int       `json:"maxUses"`
+	Uses      int       `json:"uses"`
+	UsedBy    []string  `json:"usedBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func inviteData(document InviteDocument) InviteData {
+	usedBy := document.UsedBy
+	if usedBy == nil {
+		usedBy = []string{}
+	}
+	return InviteData{
+		ID:        document.ID.Hex(),
+		CreatedBy: document.CreatedBy,
+		MaxUses:   document.MaxUses,
+		Uses:      document.MaxUses - document.UsesLeft,
+		UsedBy:    usedBy,
+		CreatedAt: document.CreatedAt,
+		ExpiresAt: document.ExpiresAt,
+	}
+}
+
+func invitesHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	if r.Method == "POST" {
+		createInviteHandler(w, r, username)
+	} else {
+		getInvitesHandler(w, r, username)
+	}
+}
+
+// writeInvites writes the invites matching a filter, newest first.
+func writeInvites(w http.ResponseWriter, filter bson.M) {
+	cursor, err := database.Collection("invites").Find(
+		mongoCtx, filter, options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}),
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	var documents []InviteDocument
+	err = cursor.All(mongoCtx, &documents)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	invites := make([]InviteData, 0, len(documents))
+	for _, document := range documents {
+		invites = append(invites, inviteData(document))
+	}
+	json.NewEncoder(w).Encode(struct {
+		Invites []InviteData `json:"invites"`
+	}{Invites: invites})
+}
+
+func getInvitesHandler(w http.ResponseWriter, r *http.Request, username string) {
+	writeInvites(w, bson.M{"createdBy": username})
+}
+
+type CreateInviteData struct {
+	MaxUses   int             `json:"maxUses"`
+	ExpiresAt json.RawMessage `json:"expiresAt"`
+}
+
+func createInviteHandler(w http.ResponseWriter, r *http.Request, username string) {
+	if config.Registration.Mode != registrationInvite {
+		http.Error(w, `{"error":"Registration does not use invites on this server!"}`, http.StatusBadRequest)
+		return
+	}
+	if config.Registration.AdminOnlyInvites {
+		isAdmin, err := userHasRole(username, roleAdmin)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+			return
+		} else if !isAdmin {
+			http.Error(w, `{"error":"Only admins can create invites!"}`, http.StatusForbidden)
+			return
+		}
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var inviteBody CreateInviteData
+	err = json.Unmarshal(body, &inviteBody)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	} else if inviteBody.MaxUses == 0 {
+		inviteBody.MaxUses = 1
+	} else if inviteBody.MaxUses < 0 || inviteBody.MaxUses > inviteMaxUses {
+		http.Error(w, `{"error":"Invites can be used 1-1000 times!"}`, http.StatusBadRequest)
+		return
+	}
+	nowTime := time.Now().UTC()
+	expiresAt := nowTime.Add(inviteDefaultLifetime)
+	if len(inviteBody.ExpiresAt) > 0 && string(inviteBody.ExpiresAt) != "null" {
+		expiresAt, err = time.Parse("2006-01-02T15:04:05.999Z07:00", strings.Trim(string(inviteBody.ExpiresAt), `"`))
+		if err != nil || !expiresAt.After(nowTime) || expiresAt.After(nowTime.Add(inviteMaxLifetime)) {
+			http.Error(w, `{"error":"Invalid expiry date provided! Invites can last up to 90 days."}`, http.StatusBadRequest)
+			return
+		}
+		expiresAt = expiresAt.UTC()
+	}
+	bytes, err := generateToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	code := hex.EncodeToString(bytes)
+	document := InviteDocument{
+		Code:       hashToken(code),
+		CreatedBy:  username,
+		MaxUses:    inviteBody.MaxUses,
+		UsesLeft:   inviteBody.MaxUses,
+		CreatedAt:  nowTime,
+		ExpiresAt:  expiresAt,
+		PurgeAfter: expiresAt.Add(config.Registration.InviteRetention.Duration),
+	}
+	result, err := database.Collection("invites").InsertOne(mongoCtx, document)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	document.ID = result.InsertedID.(primitive.ObjectID)
+	data := inviteData(document)
+	data.Code = code
+	json.NewEncoder(w).Encode(data)
+}
+
+// deleteInvite deletes an invite by the ID in the path, only matching invites created by a user unless
+// createdBy is empty. It returns the ID of the deleted invite, or an empty string if none was deleted.
+func deleteInvite(w http.ResponseWriter, r *http.Request, pathSegments []string, createdBy string) string {
+	if len(pathSegments) != 1 {
+		http.NotFound(w, r)
+		return ""
+	}
+	id, err := primitive.ObjectIDFromHex(pathSegments[0])
+	if err != nil {
+		http.Error(w, `{"error":"Invite not found!"}`, http.StatusNotFound)
+		return ""
+	}
+	filter := bson.M{"_id": id}
+	if createdBy != "" {
+		filter["createdBy"] = createdBy
+	}
+	result, err := database.Collection("invites").DeleteOne(mongoCtx, filter)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return ""
+	} else if result.DeletedCount == 0 {
+		http.Error(w, `{"error":"Invite not found!"}`, http.StatusNotFound)
+		return ""
+	}
+	w.Write([]byte(`{"success":true}`))
+	return id.Hex()
+}
+
+func deleteInviteHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	deleteInvite(w, r, strings.Split(r.URL.Path, "/")[2:], username)
+}
+
+func getAdminInvitesHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	writeInvites(w, bson.M{})
+}
+
+func deleteAdminInviteHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	if id := deleteInvite(w, r, strings.Split(r.URL.Path, "/")[3:], ""); id != "" {
+		infoLog.Printf("%s deleted the invite %s.\n", username, id)
+	}
+}
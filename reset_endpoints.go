@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const passwordResetLifetime = time.Hour
+const passwordResetInterval = time.Minute * 5
+
+func sendPasswordResetEmail(email string, username string, token string) error {
+	link := config.FrontendUrl + "/resetpassword?token=" + url.QueryEscape(token)
+	return mailer.SendMail(email, "Reset your Cerulean password",
+		"Hi "+username+",\n\n"+
+			"Someone requested a password reset for your Cerulean account. To choose a new password, open the link below:\n\n"+
+			link+"\n\n"+
+			"This link expires in 1 hour and can only be used once. If you did not request this, you can ignore this email.\n")
+}
+
+type ForgotPasswordData struct {
+	Email string `json:"email"`
+}
+
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var forgotData ForgotPasswordData
+	err = json.Unmarshal(body, &forgotData)
+	if err != nil || forgotData.Email == "" {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	// Never reveal whether an account with this email exists, so all non-errors return success.
+	result := database.Collection("users").FindOne(mongoCtx, bson.M{"email": forgotData.Email})
+	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+		w.Write([]byte(`{"success":true}`))
+		return
+	} else if result.Err() != nil {
+		log.Println(result.Err())
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	var user UserDocument
+	err = result.Decode(&user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	nowTime := time.Now().UTC()
+	if user.PasswordResetSentAt.Add(passwordResetInterval).After(nowTime) {
+		w.Write([]byte(`{"success":true}`))
+		return
+	}
+	bytes, err := generateToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(bytes)
+	_, err = database.Collection("users").UpdateOne(
+		mongoCtx, bson.M{"username": user.Username}, bson.M{"$set": bson.M{
+			"passwordReset":          hashToken(token),
+			"passwordResetExpiresAt": nowTime.Add(passwordResetLifetime),
+			"passwordResetSentAt":    nowTime,
+		}},
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	// Send in the background, so response times don't reveal whether the account exists.
+	go func() {
+		err := sendPasswordResetEmail(user.Email, user.Username, token)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+	w.Write([]byte(`{"success":true}`))
+}
+
+type ResetPasswordData struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var resetData ResetPasswordData
+	err = json.Unmarshal(body, &resetData)
+	if err != nil || resetData.Token == "" || resetData.NewPassword == "" {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	tokenFilter := bson.M{
+		"passwordReset":          hashToken(resetData.Token),
+		"passwordResetExpiresAt": bson.M{"$gt": time.Now().UTC()},
+	}
+	var user UserDocument
+	err = database.Collection("users").FindOne(mongoCtx, tokenFilter).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, `{"error":"Invalid or expired password reset token!"}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	reasons, err := checkPasswordPolicy(resetData.NewPassword, user.Username, user.Email)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if reasons != nil {
+		writePasswordPolicyError(w, "newPassword", reasons)
+		return
+	}
+	passwordHash, err := hashPassword(resetData.NewPassword)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	// Redeeming the token also verifies the account, since the user has proven they own the email.
+	result := database.Collection("users").FindOneAndUpdate(
+		mongoCtx,
+		tokenFilter,
+		bson.M{
+			"$set": bson.M{
+				"password": passwordHash,
+				"verified": "",
+			},
+			"$unset": bson.M{
+				"salt":                   1,
+				"passwordReset":          1,
+				"passwordResetExpiresAt": 1,
+				"verifyExpiresAt":        1,
+				"verifySentAt":           1,
+			},
+		},
+	)
+	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+		http.Error(w, `{"error":"Invalid or expired password reset token!"}`, http.StatusBadRequest)
+		return
+	} else if result.Err() != nil {
+		log.Println(result.Err())
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	err = result.Decode(&user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	_, err = database.Collection("tokens").DeleteMany(mongoCtx, bson.M{"username": user.Username})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	recordAuditEvent(r, user.Username, auditPasswordReset, auditSuccess, "")
+	w.Write([]byte(`{"success":true}`))
+}
@@ -8,7 +8,7 @@ import (
 )
 
 var UsersCollectionSchema = bson.M{
-	"required": []string{"username", "email", "password", "salt", "todos", "lastEdited"},
+	"required": []string{"username", "email", "password", "todos", "lastEdited"},
 	"properties": bson.M{
 		"username": bson.M{
 			"bsonType":  "string",
@@ -30,9 +30,51 @@ var UsersCollectionSchema = bson.M{
 			"maxLength": 254,
 			"pattern":   "^[a-zA-Z0-9_.+-]+@[a-zA-Z0-9-]+\\.[a-zA-Z0-9-.]+$",
 		},
-		"verified": bson.M{
+		"verified":        bson.M{"bsonType": "string"},
+		"verifyExpiresAt": bson.M{"bsonType": "date"},
+		"verifySentAt":    bson.M{"bsonType": "date"},
+		"passwordReset": bson.M{
 			"bsonType":  "string",
-			"minLength": 16,
+			"minLength": 64,
+			"maxLength": 64,
+		},
+		"passwordResetExpiresAt": bson.M{"bsonType": "date"},
+		"passwordResetSentAt":    bson.M{"bsonType": "date"},
+		"totpSecret":             bson.M{"bsonType": "string", "minLength": 16},
+		"totpPendingSecret":      bson.M{"bsonType": "string", "minLength": 16},
+		"totpLastCounter":        bson.M{"bsonType": "long"},
+		"recoveryCodes": bson.M{
+			"bsonType": "array",
+			"items":    bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{64}$"},
+		},
+		"pendingEmail": bson.M{
+			"bsonType":  "string",
+			"maxLength": 254,
+			"pattern":   "^[a-zA-Z0-9_.+-]+@[a-zA-Z0-9-]+\\.[a-zA-Z0-9-.]+$",
+		},
+		"pendingEmailToken":     bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{64}$"},
+		"pendingEmailExpiresAt": bson.M{"bsonType": "date"},
+		"previousEmail":         bson.M{"bsonType": "string"},
+		"emailRevertToken":      bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{64}$"},
+		"emailRevertExpiresAt":  bson.M{"bsonType": "date"},
+		"role":                  bson.M{"bsonType": "string", "enum": []string{"user", "admin"}},
+		"disabled":              bson.M{"bsonType": "bool"},
+		"deletedAt":             bson.M{"bsonType": "date"},
+		"deleteAfter":           bson.M{"bsonType": "date"},
+		"restoreToken":          bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{64}$"},
+		"suspendedUntil":        bson.M{"bsonType": "date"},
+		"suspensionReason":      bson.M{"bsonType": "string", "maxLength": 500},
+		"suspendedBy":           bson.M{"bsonType": "string"},
+		"oidcIdentities": bson.M{
+			"bsonType": "array",
+			"items": bson.M{
+				"bsonType": "object",
+				"required": []string{"provider", "subject"},
+				"properties": bson.M{
+					"provider": bson.M{"bsonType": "string"},
+					"subject":  bson.M{"bsonType": "string", "minLength": 1},
+				},
+			},
 		},
 		"lastEdited": bson.M{"bsonType": "date"},
 		"todos": bson.M{
@@ -56,13 +98,42 @@ var UsersCollectionSchema = bson.M{
 }
 
 type UserDocument struct {
-	Username   string         `json:"username" bson:"username"`
-	Password   string         `json:"password" bson:"password"`
-	Salt       string         `json:"salt" bson:"salt"`
-	Email      string         `json:"email" bson:"email"`
-	Verified   string         `json:"verified" bson:"verified"`
-	LastEdited time.Time      `json:"lastEdited" bson:"lastEdited"`
-	Todos      []TodoDocument `json:"todos" bson:"todos"`
+	Username               string         `json:"username" bson:"username"`
+	Password               string         `json:"password" bson:"password"`
+	Salt                   string         `json:"salt" bson:"salt,omitempty"` // Only set for legacy password hashes.
+	Email                  string         `json:"email" bson:"email"`
+	Verified               string         `json:"verified" bson:"verified"` // SHA-256 digest of the verification token, empty once verified.
+	VerifyExpiresAt        time.Time      `json:"verifyExpiresAt" bson:"verifyExpiresAt,omitempty"`
+	VerifySentAt           time.Time      `json:"verifySentAt" bson:"verifySentAt,omitempty"`
+	PasswordReset          string         `json:"passwordReset" bson:"passwordReset,omitempty"`
+	PasswordResetExpiresAt time.Time      `json:"passwordResetExpiresAt" bson:"passwordResetExpiresAt,omitempty"`
+	PasswordResetSentAt    time.Time      `json:"passwordResetSentAt" bson:"passwordResetSentAt,omitempty"`
+	TOTPSecret             string         `json:"totpSecret" bson:"totpSecret,omitempty"`
+	TOTPPendingSecret      string         `json:"totpPendingSecret" bson:"totpPendingSecret,omitempty"`
+	TOTPLastCounter        int64          `json:"totpLastCounter" bson:"totpLastCounter,omitempty"`
+	RecoveryCodes          []string       `json:"recoveryCodes" bson:"recoveryCodes,omitempty"`
+	OIDCIdentities         []OIDCIdentity `json:"oidcIdentities" bson:"oidcIdentities,omitempty"`
+	PendingEmail           string         `json:"pendingEmail" bson:"pendingEmail,omitempty"`
+	PendingEmailToken      string         `json:"pendingEmailToken" bson:"pendingEmailToken,omitempty"`
+	PendingEmailExpiresAt  time.Time      `json:"pendingEmailExpiresAt" bson:"pendingEmailExpiresAt,omitempty"`
+	PreviousEmail          string         `json:"previousEmail" bson:"previousEmail,omitempty"`
+	EmailRevertToken       string         `json:"emailRevertToken" bson:"emailRevertToken,omitempty"`
+	EmailRevertExpiresAt   time.Time      `json:"emailRevertExpiresAt" bson:"emailRevertExpiresAt,omitempty"`
+	Role                   string         `json:"role" bson:"role,omitempty"` // Empty for the user role.
+	Disabled               bool           `json:"disabled" bson:"disabled,omitempty"`
+	DeletedAt              time.Time      `json:"deletedAt" bson:"deletedAt,omitempty"`
+	DeleteAfter            time.Time      `json:"deleteAfter" bson:"deleteAfter,omitempty"`
+	RestoreToken           string         `json:"restoreToken" bson:"restoreToken,omitempty"`
+	SuspendedUntil         time.Time      `json:"suspendedUntil" bson:"suspendedUntil,omitempty"`
+	SuspensionReason       string         `json:"suspensionReason" bson:"suspensionReason,omitempty"`
+	SuspendedBy            string         `json:"suspendedBy" bson:"suspendedBy,omitempty"`
+	LastEdited             time.Time      `json:"lastEdited" bson:"lastEdited"`
+	Todos                  []TodoDocument `json:"todos" bson:"todos"`
+}
+
+type OIDCIdentity struct {
+	Provider string `json:"provider" bson:"provider"`
+	Subject  string `json:"subject" bson:"subject"`
 }
 
 type TodoDocument struct {
@@ -77,16 +148,298 @@ type TodoDocument struct {
 }
 
 var TokensCollectionSchema = bson.M{
-	"required": []string{"username", "token", "issuedOn"},
+	"required": []string{"username", "token", "issuedOn", "expiresAt"},
 	"properties": bson.M{
-		"token":    bson.M{"bsonType": "string", "minLength": 42},
-		"username": bson.M{"bsonType": "string", "minLength": 4},
-		"issuedOn": bson.M{"bsonType": "date"},
+		"token":      bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{64}$"},
+		"kind":       bson.M{"bsonType": "string", "enum": []string{"refresh"}},
+		"username":   bson.M{"bsonType": "string", "minLength": 4},
+		"issuedOn":   bson.M{"bsonType": "date"},
+		"expiresAt":  bson.M{"bsonType": "date"},
+		"lastUsedAt": bson.M{"bsonType": "date"},
+		"userAgent":  bson.M{"bsonType": "string"},
+		"ip":         bson.M{"bsonType": "string"},
+		"family":     bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{64}$"},
+		"clientId":   bson.M{"bsonType": "string"},
+		"scopes": bson.M{
+			"bsonType": "array",
+			"items":    bson.M{"bsonType": "string", "enum": allScopes},
+		},
 	},
 }
 
 type TokenDocument struct {
-	Username string    `json:"username" bson:"username"`
-	IssuedOn time.Time `json:"issuedOn" bson:"issuedOn"`
-	Token    string    `json:"token" bson:"token"`
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Username   string             `json:"username" bson:"username"`
+	IssuedOn   time.Time          `json:"issuedOn" bson:"issuedOn"`
+	ExpiresAt  time.Time          `json:"expiresAt" bson:"expiresAt"`
+	Token      string             `json:"token" bson:"token"` // SHA-256 digest of the token.
+	Kind       string             `json:"kind" bson:"kind,omitempty"`
+	Family     string             `json:"family" bson:"family,omitempty"`     // SHA-256 digest of the refresh token family.
+	ClientID   string             `json:"clientId" bson:"clientId,omitempty"` // OAuth client it was issued to.
+	Scopes     []string           `json:"scopes" bson:"scopes,omitempty"`
+	LastUsedAt time.Time          `json:"lastUsedAt" bson:"lastUsedAt,omitempty"`
+	UserAgent  string             `json:"userAgent" bson:"userAgent"`
+	IP         string             `json:"ip" bson:"ip"`
+}
+
+var LoginChallengesCollectionSchema = bson.M{
+	"required": []string{"challenge", "username", "attempts", "expiresAt"},
+	"properties": bson.M{
+		"challenge": bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{64}$"},
+		"username":  bson.M{"bsonType": "string", "minLength": 4},
+		"attempts":  bson.M{"bsonType": "int"},
+		"expiresAt": bson.M{"bsonType": "date"},
+	},
+}
+
+type LoginChallengeDocument struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Challenge string             `json:"challenge" bson:"challenge"` // SHA-256 digest of the challenge.
+	Username  string             `json:"username" bson:"username"`
+	Attempts  int                `json:"attempts" bson:"attempts"`
+	ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+}
+
+var APIKeysCollectionSchema = bson.M{
+	"required": []string{"key", "username", "name", "scopes", "createdAt", "expiresAt"},
+	"properties": bson.M{
+		"key":        bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{64}$"},
+		"username":   bson.M{"bsonType": "string", "minLength": 4},
+		"name":       bson.M{"bsonType": "string", "minLength": 1, "maxLength": 64},
+		"createdAt":  bson.M{"bsonType": "date"},
+		"expiresAt":  bson.M{"bsonType": "date"},
+		"lastUsedAt": bson.M{"bsonType": "date"},
+		"scopes": bson.M{
+			"bsonType": "array",
+			"minItems": 1,
+			"items":    bson.M{"bsonType": "string", "enum": allScopes},
+		},
+	},
+}
+
+type APIKeyDocument struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Key        string             `json:"key" bson:"key"` // SHA-256 digest of the key.
+	Username   string             `json:"username" bson:"username"`
+	Name       string             `json:"name" bson:"name"`
+	Scopes     []string           `json:"scopes" bson:"scopes"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	ExpiresAt  time.Time          `json:"expiresAt" bson:"expiresAt"`
+	LastUsedAt time.Time          `json:"lastUsedAt" bson:"lastUsedAt,omitempty"`
+}
+
+var OAuthClientsCollectionSchema = bson.M{
+	"required": []string{"clientId", "name", "redirectUris", "owner", "createdAt"},
+	"properties": bson.M{
+		"clientId":  bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{32}$"},
+		"secret":    bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{64}$"},
+		"name":      bson.M{"bsonType": "string", "minLength": 1, "maxLength": 64},
+		"owner":     bson.M{"bsonType": "string", "minLength": 4},
+		"createdAt": bson.M{"bsonType": "date"},
+		"redirectUris": bson.M{
+			"bsonType": "array",
+			"minItems": 1,
+			"items":    bson.M{"bsonType": "string", "minLength": 1},
+		},
+	},
+}
+
+type OAuthClientDocument struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ClientID     string             `json:"clientId" bson:"clientId"`
+	Secret       string             `json:"secret" bson:"secret,omitempty"` // SHA-256 digest of the secret.
+	Name         string             `json:"name" bson:"name"`
+	RedirectURIs []string           `json:"redirectUris" bson:"redirectUris"`
+	Owner        string             `json:"owner" bson:"owner"`
+	CreatedAt    time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+var OAuthCodesCollectionSchema = bson.M{
+	"required": []string{
+		"code", "clientId", "username", "redirectUri", "redirectUriProvided", "scopes", "codeChallenge", "expiresAt",
+	},
+	"properties": bson.M{
+		"code":                bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{64}$"},
+		"clientId":            bson.M{"bsonType": "string"},
+		"username":            bson.M{"bsonType": "string", "minLength": 4},
+		"redirectUri":         bson.M{"bsonType": "string"},
+		"redirectUriProvided": bson.M{"bsonType": "bool"},
+		"codeChallenge":       bson.M{"bsonType": "string", "minLength": 43},
+		"expiresAt":           bson.M{"bsonType": "date"},
+		"scopes": bson.M{
+			"bsonType": "array",
+			"items":    bson.M{"bsonType": "string", "enum": allScopes},
+		},
+	},
+}
+
+type OAuthCodeDocument struct {
+	ID                  primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Code                string             `json:"code" bson:"code"` // SHA-256 digest of the code.
+	ClientID            string             `json:"clientId" bson:"clientId"`
+	Username            string             `json:"username" bson:"username"`
+	RedirectURI         string             `json:"redirectUri" bson:"redirectUri"`
+	RedirectURIProvided bool               `json:"redirectUriProvided" bson:"redirectUriProvided"`
+	Scopes              []string           `json:"scopes" bson:"scopes"`
+	CodeChallenge       string             `json:"codeChallenge" bson:"codeChallenge"`
+	ExpiresAt           time.Time          `json:"expiresAt" bson:"expiresAt"`
+}
+
+var OIDCStatesCollectionSchema = bson.M{
+	"required": []string{"state", "provider", "nonce", "codeVerifier", "expiresAt"},
+	"properties": bson.M{
+		"state":        bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{64}$"},
+		"provider":     bson.M{"bsonType": "string"},
+		"nonce":        bson.M{"bsonType": "string", "minLength": 43},
+		"codeVerifier": bson.M{"bsonType": "string", "minLength": 43},
+		"expiresAt":    bson.M{"bsonType": "date"},
+	},
+}
+
+type OIDCStateDocument struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	State        string             `json:"state" bson:"state"` // SHA-256 digest of the state.
+	Provider     string             `json:"provider" bson:"provider"`
+	Nonce        string             `json:"nonce" bson:"nonce"`
+	CodeVerifier string             `json:"codeVerifier" bson:"codeVerifier"`
+	ExpiresAt    time.Time          `json:"expiresAt" bson:"expiresAt"`
+}
+
+var LoginAttemptsCollectionSchema = bson.M{
+	"required": []string{"key", "failures", "lastFailureAt", "expiresAt"},
+	"properties": bson.M{
+		"key":           bson.M{"bsonType": "string", "pattern": "^(user|ip):"},
+		"failures":      bson.M{"bsonType": bson.A{"int", "long"}, "minimum": 1},
+		"lastFailureAt": bson.M{"bsonType": "date"},
+		"lockedUntil":   bson.M{"bsonType": "date"},
+		"expiresAt":     bson.M{"bsonType": "date"},
+	},
+}
+
+type LoginAttemptDocument struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Key           string             `json:"key" bson:"key"` // "user:<username>" or "ip:<address>".
+	Failures      int                `json:"failures" bson:"failures"`
+	LastFailureAt time.Time          `json:"lastFailureAt" bson:"lastFailureAt"`
+	LockedUntil   time.Time          `json:"lockedUntil" bson:"lockedUntil,omitempty"`
+	ExpiresAt     time.Time          `json:"expiresAt" bson:"expiresAt"`
+}
+
+var RateLimitsCollectionSchema = bson.M{
+	"required": []string{"tokens", "updatedAt"},
+	"properties": bson.M{
+		"_id":       bson.M{"bsonType": "string"},
+		"tokens":    bson.M{"bsonType": "double", "minimum": 0},
+		"allowed":   bson.M{"bsonType": "bool"},
+		"updatedAt": bson.M{"bsonType": "date"},
+		"expiresAt": bson.M{"bsonType": "date"},
+	},
+}
+
+type RateLimitDocument struct {
+	Key       string    `json:"key" bson:"_id"`
+	Tokens    float64   `json:"tokens" bson:"tokens"`
+	Allowed   bool      `json:"allowed" bson:"allowed"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+	ExpiresAt time.Time `json:"expiresAt" bson:"expiresAt,omitempty"`
+}
+
+var ReservedUsernamesCollectionSchema = bson.M{
+	"required": []string{"username", "owner", "expiresAt"},
+	"properties": bson.M{
+		"username":  bson.M{"bsonType": "string", "minLength": 4},
+		"owner":     bson.M{"bsonType": "string", "minLength": 4},
+		"expiresAt": bson.M{"bsonType": "date"},
+	},
+}
+
+type ReservedUsernameDocument struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Username  string             `json:"username" bson:"username"`
+	Owner     string             `json:"owner" bson:"owner"` // The current username of the previous owner.
+	ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+}
+
+var AuditEventsCollectionSchema = bson.M{
+	"required": []string{"userId", "username", "event", "outcome", "ip", "userAgent", "createdAt", "expiresAt"},
+	"properties": bson.M{
+		"userId":    bson.M{"bsonType": "objectId"},
+		"username":  bson.M{"bsonType": "string", "minLength": 4},
+		"event":     bson.M{"bsonType": "string"},
+		"outcome":   bson.M{"bsonType": "string", "enum": []string{"success", "failure"}},
+		"details":   bson.M{"bsonType": "string"},
+		"ip":        bson.M{"bsonType": "string"},
+		"userAgent": bson.M{"bsonType": "string"},
+		"createdAt": bson.M{"bsonType": "date"},
+		"expiresAt": bson.M{"bsonType": "date"},
+	},
+}
+
+type AuditEventDocument struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `json:"userId" bson:"userId"`
+	Username  string             `json:"username" bson:"username"` // The username when the event was recorded.
+	Event     string             `json:"event" bson:"event"`
+	Outcome   string             `json:"outcome" bson:"outcome"`
+	Details   string             `json:"details" bson:"details,omitempty"`
+	IP        string             `json:"ip" bson:"ip"`
+	UserAgent string             `json:"userAgent" bson:"userAgent"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+}
+
+var InvitesCollectionSchema = bson.M{
+	"required": []string{"code", "createdBy", "maxUses", "usesLeft", "createdAt", "expiresAt", "purgeAfter"},
+	"properties": bson.M{
+		"code":       bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{64}$"},
+		"createdBy":  bson.M{"bsonType": "string", "minLength": 4},
+		"maxUses":    bson.M{"bsonType": bson.A{"int", "long"}, "minimum": 1},
+		"usesLeft":   bson.M{"bsonType": bson.A{"int", "long"}, "minimum": 0},
+		"usedBy":     bson.M{"bsonType": "array", "items": bson.M{"bsonType": "string"}},
+		"createdAt":  bson.M{"bsonType": "date"},
+		"expiresAt":  bson.M{"bsonType": "date"},
+		"purgeAfter": bson.M{"bsonType": "date"},
+	},
+}
+
+type InviteDocument struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Code       string             `json:"code" bson:"code"` // SHA-256 digest of the code.
+	CreatedBy  string             `json:"createdBy" bson:"createdBy"`
+	MaxUses    int                `json:"maxUses" bson:"maxUses"`
+	UsesLeft   int                `json:"usesLeft" bson:"usesLeft"`
+	UsedBy     []string           `json:"usedBy" bson:"usedBy,omitempty"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	ExpiresAt  time.Time          `json:"expiresAt" bson:"expiresAt"`
+	PurgeAfter time.Time          `json:"purgeAfter" bson:"purgeAfter"` // Kept after expiring so it's known who used it.
+}
+
+var UsedChallengesCollectionSchema = bson.M{
+	"required": []string{"challenge", "expiresAt"},
+	"properties": bson.M{
+		"challenge": bson.M{"bsonType": "string", "pattern": "^[0-9a-f]{64}$"},
+		"expiresAt": bson.M{"bsonType": "date"},
+	},
+}
+
+type UsedChallengeDocument struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Challenge string             `json:"challenge" bson:"challenge"` // SHA-256 digest of the challenge.
+	ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+}
+
+var AdminPromotionsCollectionSchema = bson.M{
+	"required": []string{"username", "userId", "promotedAt"},
+	"properties": bson.M{
+		"username":   bson.M{"bsonType": "string"},
+		"userId":     bson.M{"bsonType": "objectId"},
+		"promotedAt": bson.M{"bsonType": "date"},
+	},
+}
+
+type AdminPromotionDocument struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Username   string             `json:"username" bson:"username"` // The username listed in config.json.
+	UserID     primitive.ObjectID `json:"userId" bson:"userId"`
+	PromotedAt time.Time          `json:"promotedAt" bson:"promotedAt"`
 }
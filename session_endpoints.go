@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type SessionConfig struct {
+	Mode                string   `json:"mode"`
+	Lifetime            Duration `json:"lifetime"`
+	IdleTimeout         Duration `json:"idleTimeout"`
+	Sliding             bool     `json:"sliding"`
+	LastUsedInterval    Duration `json:"lastUsedInterval"`
+	AccessTokenLifetime Duration `json:"accessTokenLifetime"`
+}
+
+func (c *SessionConfig) setDefaults() error {
+	if c.Mode == "" {
+		c.Mode = "opaque"
+	} else if c.Mode != "opaque" && c.Mode != "jwt" {
+		return fmt.Errorf("unknown session mode: %s", c.Mode)
+	}
+	if c.AccessTokenLifetime.Duration <= 0 {
+		c.AccessTokenLifetime.Duration = time.Minute * 15
+	}
+	if c.Lifetime.Duration <= 0 {
+		c.Lifetime.Duration = time.Hour * 24 * 180
+	}
+	if c.LastUsedInterval.Duration <= 0 {
+		c.LastUsedInterval.Duration = time.Minute * 5
+	}
+	// lastUsedAt must be updated often enough for active sessions to not hit the idle timeout.
+	if c.IdleTimeout.Duration > 0 && c.LastUsedInterval.Duration > c.IdleTimeout.Duration/2 {
+		c.LastUsedInterval.Duration = c.IdleTimeout.Duration / 2
+	}
+	return nil
+}
+
+// sessionExpiresAt calculates when a session expires based on when it was issued and last used.
+func sessionExpiresAt(issuedOn time.Time, lastUsedAt time.Time) time.Time {
+	expiresAt := issuedOn.Add(config.Session.Lifetime.Duration)
+	if config.Session.Sliding {
+		expiresAt = lastUsedAt.Add(config.Session.Lifetime.Duration)
+	}
+	if idleTimeout := config.Session.IdleTimeout.Duration; idleTimeout > 0 && lastUsedAt.Add(idleTimeout).Before(expiresAt) {
+		expiresAt = lastUsedAt.Add(idleTimeout)
+	}
+	return expiresAt
+}
+
+// createSession issues a new token for the user, recording the device it was issued to.
+func createSession(r *http.Request, username string) (string, error) {
+	bytes, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	token := base64.StdEncoding.EncodeToString(bytes)
+	nowTime := time.Now().UTC()
+	_, err = database.Collection("tokens").InsertOne(mongoCtx, bson.M{
+		"token":      hashToken(token),
+		"username":   username,
+		"issuedOn":   nowTime,
+		"expiresAt":  sessionExpiresAt(nowTime, nowTime),
+		"lastUsedAt": nowTime,
+		"userAgent":  r.UserAgent(),
+		"ip":         clientIP(r),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+type SessionData struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	IssuedOn   time.Time `json:"issuedOn"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	Current    bool      `json:"current"`
+}
+
+func getSessionsHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	cursor, err := database.Collection("tokens").Find(
+		mongoCtx,
+		bson.M{"username": username, "clientId": bson.M{"$exists": false}},
+		options.Find().SetSort(bson.M{"issuedOn": -1}),
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	var documents []TokenDocument
+	err = cursor.All(mongoCtx, &documents)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	currentSession := sessionFilter(token)
+	sessions := make([]SessionData, 0, len(documents))
+	for _, document := range documents {
+		lastUsedAt := document.LastUsedAt
+		if lastUsedAt.IsZero() {
+			lastUsedAt = document.IssuedOn
+		}
+		sessions = append(sessions, SessionData{
+			ID:         document.ID.Hex(),
+			UserAgent:  document.UserAgent,
+			IP:         document.IP,
+			IssuedOn:   document.IssuedOn,
+			LastUsedAt: lastUsedAt,
+			Current:    document.ID == currentSession["_id"] || document.Token == currentSession["token"],
+		})
+	}
+	json.NewEncoder(w).Encode(struct {
+		Sessions []SessionData `json:"sessions"`
+	}{Sessions: sessions})
+}
+
+func deleteSessionHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	pathSegments := strings.Split(r.URL.Path, "/")[2:]
+	if len(pathSegments) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(pathSegments[0])
+	if err != nil {
+		http.Error(w, `{"error":"Session not found!"}`, http.StatusNotFound)
+		return
+	}
+	result, err := database.Collection("tokens").DeleteOne(mongoCtx, bson.M{"_id": id, "username": username})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if result.DeletedCount == 0 {
+		http.Error(w, `{"error":"Session not found!"}`, http.StatusNotFound)
+		return
+	}
+	recordAuditEvent(r, username, auditTokenRevoke, auditSuccess, "Session "+id.Hex())
+	w.Write([]byte(`{"success":true}`))
+}
+
+func revokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	result, err := database.Collection("tokens").DeleteMany(
+		mongoCtx, bson.M{"username": username, "clientId": bson.M{"$exists": false}, "$nor": bson.A{sessionFilter(token)}},
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	recordAuditEvent(r, username, auditTokenRevoke, auditSuccess, fmt.Sprintf("%d other sessions", result.DeletedCount))
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "revoked": result.DeletedCount})
+}
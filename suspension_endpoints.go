@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Suspended accounts can't log in or use their existing tokens and API keys until the suspension ends, but
+// unlike deleted accounts, none of their data is removed.
+
+const maxSuspensionReasonLength = 500
+
+type accountSuspendedError struct {
+	until  time.Time
+	reason string
+}
+
+func (e *accountSuspendedError) Error() string {
+	return "account suspended until " + e.until.Format(time.RFC3339)
+}
+
+// checkAccountStatus checks if a user can still use their tokens and API keys. It returns false if the account
+// no longer exists, is disabled or is pending deletion, and an *accountSuspendedError if it is suspended.
+func checkAccountStatus(username string) (bool, error) {
+	var user UserDocument
+	err := database.Collection("users").FindOne(
+		mongoCtx,
+		bson.M{"username": username},
+		options.FindOne().SetProjection(bson.M{
+			"disabled": 1, "deleteAfter": 1, "suspendedUntil": 1, "suspensionReason": 1,
+		}),
+	).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if user.SuspendedUntil.After(time.Now()) {
+		return false, &accountSuspendedError{until: user.SuspendedUntil, reason: user.SuspensionReason}
+	}
+	return !user.Disabled && user.DeleteAfter.IsZero(), nil
+}
+
+// writeAccountSuspended responds with a 403 that clients can tell apart from other errors by its code.
+func writeAccountSuspended(w http.ResponseWriter, until time.Time, reason string) {
+	errorJson, _ := json.Marshal(map[string]interface{}{
+		"error":          "This account has been suspended!",
+		"code":           "account_suspended",
+		"suspendedUntil": until,
+		"reason":         reason,
+	})
+	http.Error(w, string(errorJson), http.StatusForbidden)
+}
+
+type SuspendUserData struct {
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+func suspendUserHandler(w http.ResponseWriter, r *http.Request, username string, target string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var suspendData SuspendUserData
+	err = json.Unmarshal(body, &suspendData)
+	if err != nil || suspendData.Reason == "" || len(suspendData.Reason) > maxSuspensionReasonLength {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	} else if !suspendData.Until.After(time.Now()) {
+		http.Error(w, `{"error":"Suspensions must end in the future!"}`, http.StatusBadRequest)
+		return
+	} else if target == username {
+		http.Error(w, `{"error":"You cannot suspend your own account!"}`, http.StatusBadRequest)
+		return
+	}
+	// Suspending an account again replaces the previous suspension.
+	result, err := database.Collection("users").UpdateOne(mongoCtx, bson.M{"username": target}, bson.M{
+		"$set": bson.M{
+			"suspendedUntil":   suspendData.Until.UTC(),
+			"suspensionReason": suspendData.Reason,
+			"suspendedBy":      username,
+		},
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if result.MatchedCount != 1 {
+		http.Error(w, `{"error":"User not found!"}`, http.StatusNotFound)
+		return
+	}
+	// API keys are kept, since they are rejected until the suspension ends anyway.
+	err = revokeUserSessions(target)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	recordAuditEvent(r, target, auditAccountSuspend, auditSuccess,
+		"Until "+suspendData.Until.UTC().Format(time.RFC3339)+" by "+username+": "+suspendData.Reason)
+	infoLog.Printf("%s suspended the account of %s until %s.\n", username, target, suspendData.Until.UTC())
+	w.Write([]byte(`{"success":true}`))
+}
+
+func unsuspendUserHandler(w http.ResponseWriter, r *http.Request, username string, target string) {
+	result, err := database.Collection("users").UpdateOne(mongoCtx, bson.M{"username": target}, bson.M{
+		"$unset": bson.M{"suspendedUntil": 1, "suspensionReason": 1, "suspendedBy": 1},
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if result.MatchedCount != 1 {
+		http.Error(w, `{"error":"User not found!"}`, http.StatusNotFound)
+		return
+	} else if result.ModifiedCount != 1 {
+		http.Error(w, `{"error":"This account is not suspended!"}`, http.StatusBadRequest)
+		return
+	}
+	recordAuditEvent(r, target, auditAccountUnsuspend, auditSuccess, "By "+username)
+	infoLog.Printf("%s lifted the suspension of %s.\n", username, target)
+	w.Write([]byte(`{"success":true}`))
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TOTP as defined in RFC 6238, with the defaults used by authenticator apps: SHA-1, 6 digits, 30s steps.
+const totpPeriod = 30
+const totpDigits = 6
+const totpSkew = 1
+const recoveryCodeCount = 10
+const loginChallengeLifetime = time.Minute * 5
+const loginChallengeAttempts = 5
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpCode(secret []byte, counter int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// verifyTOTP checks a code against the secret, and returns the time step it was valid for. Codes for
+// time steps at or before lastCounter are rejected, so a code can't be used twice.
+func verifyTOTP(encodedSecret string, code string, lastCounter int64) (int64, bool) {
+	secret, err := totpEncoding.DecodeString(encodedSecret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	counter := time.Now().UTC().Unix() / totpPeriod
+	for i := counter - totpSkew; i <= counter+totpSkew; i++ {
+		if i > lastCounter && hmac.Equal([]byte(totpCode(secret, i)), []byte(code)) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func normaliseRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// generateRecoveryCodes returns recovery codes to show to the user, and their digests to store.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		bytes := make([]byte, 5)
+		_, err := rand.Read(bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(bytes)
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// useSecondFactor checks a TOTP or recovery code for a user, consuming it if valid.
+func useSecondFactor(user *UserDocument, code string, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		result, err := database.Collection("users").UpdateOne(
+			mongoCtx,
+			bson.M{"username": user.Username, "recoveryCodes": hashToken(normaliseRecoveryCode(recoveryCode))},
+			bson.M{"$pull": bson.M{"recoveryCodes": hashToken(normaliseRecoveryCode(recoveryCode))}},
+		)
+		if err != nil {
+			return false, err
+		}
+		return result.ModifiedCount == 1, nil
+	}
+	counter, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPLastCounter)
+	if !ok {
+		return false, nil
+	}
+	// Only one request can successfully use a code, even if several are made at the same time.
+	result, err := database.Collection("users").UpdateOne(
+		mongoCtx,
+		bson.M{"username": user.Username, "totpLastCounter": bson.M{"$not": bson.M{"$gte": counter}}},
+		bson.M{"$set": bson.M{"totpLastCounter": counter}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// createLoginChallenge is used in place of completeLogin for users with two-factor authentication.
+func createLoginChallenge(w http.ResponseWriter, username string) {
+	bytes, err := generateToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	challenge := hex.EncodeToString(bytes)
+	_, err = database.Collection("login_challenges").InsertOne(mongoCtx, bson.M{
+		"challenge": hashToken(challenge),
+		"username":  username,
+		"attempts":  0,
+		"expiresAt": time.Now().UTC().Add(loginChallengeLifetime),
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"twoFactorRequired": true, "challenge": challenge})
+}
+
+type LoginTwoFactorData struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+func loginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var loginData LoginTwoFactorData
+	err = json.Unmarshal(body, &loginData)
+	if err != nil || loginData.Challenge == "" || (loginData.Code == "" && loginData.RecoveryCode == "") {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var challenge LoginChallengeDocument
+	err = database.Collection("login_challenges").FindOneAndUpdate(
+		mongoCtx,
+		bson.M{
+			"challenge": hashToken(loginData.Challenge),
+			"expiresAt": bson.M{"$gt": time.Now().UTC()},
+			"attempts":  bson.M{"$lt": loginChallengeAttempts},
+		},
+		bson.M{"$inc": bson.M{"attempts": 1}},
+	).Decode(&challenge)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		http.Error(w, `{"error":"Login challenge expired! Please log in again."}`, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	// Failed codes count towards the username's lockout, since each password login gives a new challenge.
+	attemptKeys := []string{loginUserKey(challenge.Username)}
+	lockedUntil, _, err := checkLoginLockout(attemptKeys)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if !lockedUntil.IsZero() {
+		writeLoginLockout(w, lockedUntil)
+		return
+	}
+	var user UserDocument
+	err = database.Collection("users").FindOne(mongoCtx, bson.M{"username": challenge.Username}).Decode(&user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	// The account may have been deleted, disabled or suspended since the password was checked.
+	if !user.DeleteAfter.IsZero() {
+		recordAuditEvent(r, user.Username, auditLogin, auditFailure, "Account pending deletion")
+		http.Error(w, `{"error":"This account has been deleted! Check your email to restore it."}`, http.StatusForbidden)
+		return
+	} else if user.Disabled {
+		recordAuditEvent(r, user.Username, auditLogin, auditFailure, "Account disabled")
+		http.Error(w, `{"error":"This account has been disabled!"}`, http.StatusForbidden)
+		return
+	} else if user.SuspendedUntil.After(time.Now()) {
+		recordAuditEvent(r, user.Username, auditLogin, auditFailure, "Account suspended")
+		writeAccountSuspended(w, user.SuspendedUntil, user.SuspensionReason)
+		return
+	}
+	ok, err := useSecondFactor(&user, loginData.Code, loginData.RecoveryCode)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if !ok {
+		recordAuditEvent(r, user.Username, auditLogin, auditFailure, "Invalid two-factor authentication code")
+		lockedUntil, err = recordLoginFailure(attemptKeys)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		} else if !lockedUntil.IsZero() {
+			writeLoginLockout(w, lockedUntil)
+		} else {
+			http.Error(w, `{"error":"Invalid two-factor authentication code!"}`, http.StatusUnauthorized)
+		}
+		return
+	}
+	result, err := database.Collection("login_challenges").DeleteOne(mongoCtx, bson.M{"_id": challenge.ID})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if result.DeletedCount != 1 {
+		http.Error(w, `{"error":"Login challenge expired! Please log in again."}`, http.StatusUnauthorized)
+		return
+	}
+	method := "password+totp"
+	if loginData.Code == "" {
+		method = "password+recovery_code"
+	}
+	completeLogin(w, r, user.Username, method)
+}
+
+func beginTwoFactorHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	encodedSecret := totpEncoding.EncodeToString(secret)
+	result, err := database.Collection("users").UpdateOne(
+		mongoCtx,
+		bson.M{"username": username, "totpSecret": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"totpPendingSecret": encodedSecret}},
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if result.MatchedCount != 1 {
+		http.Error(w, `{"error":"Two-factor authentication is already enabled!"}`, http.StatusConflict)
+		return
+	}
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/Cerulean:" + username,
+		RawQuery: url.Values{
+			"secret":    {encodedSecret},
+			"issuer":    {"Cerulean"},
+			"algorithm": {"SHA1"},
+			"digits":    {fmt.Sprint(totpDigits)},
+			"period":    {fmt.Sprint(totpPeriod)},
+		}.Encode(),
+	}
+	json.NewEncoder(w).Encode(map[string]string{"secret": encodedSecret, "uri": uri.String()})
+}
+
+type TwoFactorCodeData struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+	Password     string `json:"password"`
+}
+
+func confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var codeData TwoFactorCodeData
+	err = json.Unmarshal(body, &codeData)
+	if err != nil || codeData.Code == "" {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var user UserDocument
+	err = database.Collection("users").FindOne(mongoCtx, bson.M{"username": username}).Decode(&user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if user.TOTPSecret != "" {
+		http.Error(w, `{"error":"Two-factor authentication is already enabled!"}`, http.StatusConflict)
+		return
+	} else if user.TOTPPendingSecret == "" {
+		http.Error(w, `{"error":"Two-factor authentication setup has not been started!"}`, http.StatusBadRequest)
+		return
+	}
+	counter, ok := verifyTOTP(user.TOTPPendingSecret, codeData.Code, 0)
+	if !ok {
+		http.Error(w, `{"error":"Invalid two-factor authentication code!"}`, http.StatusUnauthorized)
+		return
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	result, err := database.Collection("users").UpdateOne(
+		mongoCtx,
+		bson.M{"username": username, "totpPendingSecret": user.TOTPPendingSecret},
+		bson.M{
+			"$set": bson.M{
+				"totpSecret":      user.TOTPPendingSecret,
+				"totpLastCounter": counter,
+				"recoveryCodes":   hashes,
+			},
+			"$unset": bson.M{"totpPendingSecret": 1},
+		},
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if result.ModifiedCount != 1 {
+		http.Error(w, `{"error":"Two-factor authentication setup has not been started!"}`, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "recoveryCodes": codes})
+}
+
+func disableTwoFactorHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var codeData TwoFactorCodeData
+	err = json.Unmarshal(body, &codeData)
+	if err != nil || codeData.Password == "" || (codeData.Code == "" && codeData.RecoveryCode == "") {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var user UserDocument
+	err = database.Collection("users").FindOne(mongoCtx, bson.M{"username": username}).Decode(&user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if user.TOTPSecret == "" {
+		http.Error(w, `{"error":"Two-factor authentication is not enabled!"}`, http.StatusBadRequest)
+		return
+	} else if ok, _ := verifyPassword(codeData.Password, user.Password, user.Salt); !ok {
+		http.Error(w, `{"error":"Invalid password!"}`, http.StatusUnauthorized)
+		return
+	}
+	ok, err := useSecondFactor(&user, codeData.Code, codeData.RecoveryCode)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, `{"error":"Invalid two-factor authentication code!"}`, http.StatusUnauthorized)
+		return
+	}
+	_, err = database.Collection("users").UpdateOne(mongoCtx, bson.M{"username": username}, bson.M{
+		"$unset": bson.M{"totpSecret": 1, "totpPendingSecret": 1, "totpLastCounter": 1, "recoveryCodes": 1},
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(`{"success":true}`))
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+// The SHA-1 test vectors from RFC 6238 appendix B, which are 8 digits long, truncated to their last 6 digits.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		if code := totpCode(secret, test.time/totpPeriod); code != test.code {
+			t.Errorf("totpCode at %d = %s, want %s", test.time, code, test.code)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Old usernames are reserved for their previous owner for a while after being changed, so nobody else can
+// impersonate them. This is longer than access tokens last, since they contain the username.
+const usernameCooldown = time.Hour * 24 * 30
+
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]{4,16}$`)
+
+var errUsernameTaken = errors.New("username taken")
+
+// usernameReserved checks if a username is reserved for someone other than the given user.
+func usernameReserved(ctx context.Context, username string, owner string) (bool, error) {
+	err := database.Collection("reserved_usernames").FindOne(ctx, bson.M{
+		"username": username, "owner": bson.M{"$ne": owner}, "expiresAt": bson.M{"$gt": time.Now().UTC()},
+	}).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// renameUser changes a username everywhere it is stored, in a transaction so it is never half done.
+func renameUser(oldUsername string, newUsername string) error {
+	session, err := mongodb.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+	_, err = session.WithTransaction(context.Background(), func(ctx mongo.SessionContext) (interface{}, error) {
+		err := database.Collection("users").FindOne(ctx, bson.M{"username": newUsername}).Err()
+		if err == nil {
+			return nil, errUsernameTaken
+		} else if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+		reserved, err := usernameReserved(ctx, newUsername, oldUsername)
+		if err != nil {
+			return nil, err
+		} else if reserved {
+			return nil, errUsernameTaken
+		}
+		// Users can take back their own reserved usernames.
+		_, err = database.Collection("reserved_usernames").DeleteOne(ctx, bson.M{"username": newUsername})
+		if err != nil {
+			return nil, err
+		}
+		upsert := true
+		_, err = database.Collection("reserved_usernames").UpdateOne(
+			ctx,
+			bson.M{"username": oldUsername},
+			bson.M{"$set": bson.M{"owner": newUsername, "expiresAt": time.Now().UTC().Add(usernameCooldown)}},
+			&options.UpdateOptions{Upsert: &upsert},
+		)
+		if err != nil {
+			return nil, err
+		}
+		result, err := database.Collection("users").UpdateOne(
+			ctx, bson.M{"username": oldUsername}, bson.M{"$set": bson.M{"username": newUsername}},
+		)
+		if duplicateUserField(err) == "username" {
+			return nil, errUsernameTaken
+		} else if err != nil {
+			return nil, err
+		} else if result.MatchedCount != 1 {
+			return nil, mongo.ErrNoDocuments
+		}
+		cascade := []struct{ collection, field string }{
+			{"tokens", "username"},
+			{"api_keys", "username"},
+			{"login_challenges", "username"},
+			{"oauth_clients", "owner"},
+			{"oauth_codes", "username"},
+			{"reserved_usernames", "owner"},
+			{"invites", "createdBy"},
+		}
+		for _, c := range cascade {
+			_, err = database.Collection(c.collection).UpdateMany(
+				ctx, bson.M{c.field: oldUsername}, bson.M{"$set": bson.M{c.field: newUsername}},
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// Every element of usedBy with the old username is renamed, which would only be one unless the user was
+		// renamed back to an old username in the meantime.
+		_, err = database.Collection("invites").UpdateMany(
+			ctx,
+			bson.M{"usedBy": oldUsername},
+			bson.M{"$set": bson.M{"usedBy.$[name]": newUsername}},
+			options.Update().SetArrayFilters(options.ArrayFilters{Filters: bson.A{bson.M{"name": oldUsername}}}),
+		)
+		if err != nil {
+			return nil, err
+		}
+		// Move any lockout to the new username, replacing failures recorded for it while nobody had it.
+		_, err = database.Collection("login_attempts").DeleteOne(ctx, bson.M{"key": loginUserKey(newUsername)})
+		if err != nil {
+			return nil, err
+		}
+		_, err = database.Collection("login_attempts").UpdateOne(
+			ctx, bson.M{"key": loginUserKey(oldUsername)}, bson.M{"$set": bson.M{"key": loginUserKey(newUsername)}},
+		)
+		if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+	return err
+}
+
+type ChangeUsernameData struct {
+	Password    string `json:"password"`
+	NewUsername string `json:"newUsername"`
+}
+
+func changeUsernameHandler(w http.ResponseWriter, r *http.Request, username string, token string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var usernameData ChangeUsernameData
+	err = json.Unmarshal(body, &usernameData)
+	if err != nil || usernameData.Password == "" || usernameData.NewUsername == "" {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	} else if !usernameRegex.MatchString(usernameData.NewUsername) {
+		http.Error(w, `{"error":"Invalid username provided!"}`, http.StatusBadRequest)
+		return
+	} else if usernameData.NewUsername == username {
+		http.Error(w, `{"error":"This is already your username!"}`, http.StatusBadRequest)
+		return
+	}
+	var user UserDocument
+	err = database.Collection("users").FindOne(mongoCtx, bson.M{"username": username}).Decode(&user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if ok, _ := verifyPassword(usernameData.Password, user.Password, user.Salt); !ok {
+		recordAuditEvent(r, username, auditUsernameChange, auditFailure, "Invalid password")
+		http.Error(w, `{"error":"Invalid password!"}`, http.StatusUnauthorized)
+		return
+	}
+	err = renameUser(username, usernameData.NewUsername)
+	if errors.Is(err, errUsernameTaken) {
+		http.Error(w, `{"error":"A user with this username already exists!"}`, http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	recordAuditEvent(r, usernameData.NewUsername, auditUsernameChange, auditSuccess, "From "+username)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "username": usernameData.NewUsername})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const verifyTokenLifetime = time.Hour * 24
+const verifyResendInterval = time.Minute * 5
+
+func generateVerifyToken() (string, error) {
+	bytes, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+func sendVerificationEmail(email string, username string, token string) error {
+	link := config.FrontendUrl + "/verify?token=" + url.QueryEscape(token)
+	return mailer.SendMail(email, "Verify your Cerulean account",
+		"Hi "+username+",\n\n"+
+			"Welcome to Cerulean! Please verify your account by opening the link below:\n\n"+
+			link+"\n\n"+
+			"This link expires in 24 hours. If you did not create this account, you can ignore this email.\n")
+}
+
+type VerifyUserData struct {
+	Token string `json:"token"`
+}
+
+func verifyUserHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var verifyData VerifyUserData
+	err = json.Unmarshal(body, &verifyData)
+	if err != nil || verifyData.Token == "" {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	result := database.Collection("users").FindOne(mongoCtx, bson.M{"verified": hashToken(verifyData.Token)})
+	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+		http.Error(w, `{"error":"Invalid verification token!"}`, http.StatusBadRequest)
+		return
+	} else if result.Err() != nil {
+		log.Println(result.Err())
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	var user UserDocument
+	err = result.Decode(&user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if user.VerifyExpiresAt.Before(time.Now().UTC()) {
+		http.Error(w, `{"error":"Verification token expired!"}`, http.StatusBadRequest)
+		return
+	}
+	updateResult, err := database.Collection("users").UpdateOne(
+		mongoCtx, bson.M{"username": user.Username, "verified": hashToken(verifyData.Token)}, bson.M{
+			"$set":   bson.M{"verified": ""},
+			"$unset": bson.M{"verifyExpiresAt": 1, "verifySentAt": 1},
+		},
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if updateResult.ModifiedCount != 1 {
+		http.Error(w, `{"error":"Invalid verification token!"}`, http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte(`{"success":true}`))
+}
+
+type ResendVerifyEmailData struct {
+	Email string `json:"email"`
+}
+
+func resendVerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, `{"error":"Allowed methods: POST"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	var resendData ResendVerifyEmailData
+	err = json.Unmarshal(body, &resendData)
+	if err != nil || resendData.Email == "" {
+		http.Error(w, `{"error":"Invalid body sent!"}`, http.StatusBadRequest)
+		return
+	}
+	// Never reveal whether an unverified account with this email exists, so all non-errors return success.
+	result := database.Collection("users").FindOne(mongoCtx, bson.M{"email": resendData.Email})
+	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+		w.Write([]byte(`{"success":true}`))
+		return
+	} else if result.Err() != nil {
+		log.Println(result.Err())
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	var user UserDocument
+	err = result.Decode(&user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	nowTime := time.Now().UTC()
+	if user.Verified == "" || user.VerifySentAt.Add(verifyResendInterval).After(nowTime) {
+		w.Write([]byte(`{"success":true}`))
+		return
+	}
+	token, err := generateVerifyToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	}
+	// Only update if no one else has resent in the meantime.
+	updateResult, err := database.Collection("users").UpdateOne(
+		mongoCtx, bson.M{"username": user.Username, "verified": user.Verified}, bson.M{"$set": bson.M{
+			"verified":        hashToken(token),
+			"verifyExpiresAt": nowTime.Add(verifyTokenLifetime),
+			"verifySentAt":    nowTime,
+		}},
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, `{"error":"Internal Server Error!"}`, http.StatusInternalServerError)
+		return
+	} else if updateResult.ModifiedCount == 1 {
+		// Send in the background, so response times don't reveal whether the account exists.
+		go func() {
+			err := sendVerificationEmail(user.Email, user.Username, token)
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	w.Write([]byte(`{"success":true}`))
+}